@@ -1,64 +1,2660 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"maps"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/promlabs/go-instrumentation-exercise/middleware"
+	"go.opentelemetry.io/contrib/bridges/otelslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	prometheus_exporter "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/log/global"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdk_log "go.opentelemetry.io/otel/sdk/log"
+	sdk_metric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/exemplar"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdk_trace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+	// Register the gzip compressor for the OTLP/gRPC exporter.
+	_ "google.golang.org/grpc/encoding/gzip"
+)
+
+// Build information. These can be set at build time via -ldflags, e.g.
+// -ldflags "-X main.version=v1.2.3 -X main.revision=$(git rev-parse HEAD)".
+var (
+	version   = "dev"
+	revision  = "unknown"
+	buildDate = "unknown"
 )
 
-type demoAPI struct{}
+// defaultMeterName is the default instrumentation scope name of our metrics,
+// which Prometheus shows as otel_scope_name.
+const defaultMeterName = "otel-instrumentation-exercise"
+
+// instrumentationVersion returns the version to report as the
+// instrumentation scope version of our metrics: the build version if it was
+// set via -ldflags, and otherwise the main module's version, e.g. when built
+// with go install.
+func instrumentationVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+	return version
+}
+
+// demoAPIConfig holds the settings of the demo API.
+type demoAPIConfig struct {
+	// durationBuckets are the request duration histogram's bucket boundaries.
+	// If empty, the middleware's default buckets are used.
+	durationBuckets []float64
+	// nativeHistogram is set if the request duration histogram is exported as
+	// a native histogram, which has no configured bucket boundaries.
+	nativeHistogram bool
+	// errorRate is the probability (0..1) with which handlers fail with a 500.
+	errorRate float64
+	// timeout is the maximum duration of a request, after which it fails with
+	// a 503. Zero means no timeout.
+	timeout time.Duration
+	// sloThreshold is the latency below which requests count as meeting the
+	// SLO. Zero disables the SLO counter.
+	sloThreshold time.Duration
+	// recordClientSubnet adds the client's subnet to the request metrics,
+	// taken from X-Forwarded-For if trustForwarded is set.
+	recordClientSubnet bool
+	trustForwarded     bool
+	// attributeHeaders maps attribute names to the request headers that their
+	// values are taken from. Values that don't match attributeHeaderPattern
+	// are recorded as "invalid".
+	attributeHeaders       map[string]string
+	attributeHeaderPattern *regexp.Regexp
+	// rateLimit is the maximum number of API requests per second, either in
+	// total or per route. Zero means no limit.
+	rateLimit         float64
+	rateLimitPerRoute bool
+	// maxConcurrent is the maximum number of API requests handled at once, for
+	// which further requests wait up to maxConcurrentWait. Zero means no limit.
+	maxConcurrent     int
+	maxConcurrentWait time.Duration
+	// accessLog logs every API request after it has been handled.
+	accessLog bool
+	// gzip compresses responses for clients that accept it.
+	gzip bool
+	// maxBodyBytes is the maximum size of request bodies. Zero means no limit.
+	maxBodyBytes int64
+	// extraLatency is added to the simulated work of every API request, e.g.
+	// to produce a latency spike.
+	extraLatency time.Duration
+	// downstreamURL, if set, is requested by the foo handler, to demonstrate
+	// client-side instrumentation.
+	downstreamURL string
+}
+
+// metrics holds all instruments of the program. They are created once, up
+// front, and then handed to the code that records them.
+type metrics struct {
+	// http is the instrumentation middleware for API handlers.
+	http func(http.Handler) http.Handler
+	// background is nil if the background tasks are disabled.
+	background *backgroundTaskMetrics
+	// shuttingDown is set once the server starts draining, and is reported by
+	// the app.shutting_down gauge.
+	shuttingDown *atomic.Bool
+	// clientTransport records the duration of outgoing HTTP requests.
+	clientTransport http.RoundTripper
+	// instruments describes all instruments that were created, for
+	// validateInstruments and logRegisteredMetrics.
+	instruments []instrumentInfo
+}
+
+// newMetrics creates all instruments and registers the callbacks of the
+// observable ones. The background task instruments are only created if
+// backgroundEnabled is set.
+//
+// It must only be called once per meter, since the callbacks would otherwise
+// be registered (and observed) twice. The caller passes the result on to
+// everything that records metrics.
+func newMetrics(meter metric.Meter, apiCfg demoAPIConfig, backgroundEnabled bool, startTime time.Time) (*metrics, error) {
+	rec := &recordingMeter{Meter: meter}
+	meter = rec
+
+	opts := []middleware.Option{
+		middleware.WithDurationBuckets(apiCfg.durationBuckets),
+		middleware.WithSLOThreshold(apiCfg.sloThreshold),
+	}
+	if apiCfg.recordClientSubnet {
+		opts = append(opts, middleware.WithClientSubnet(apiCfg.trustForwarded))
+	}
+	for name, header := range apiCfg.attributeHeaders {
+		opts = append(opts, middleware.WithHeaderAttribute(name, header, apiCfg.attributeHeaderPattern))
+	}
+	if apiCfg.rateLimit > 0 {
+		opts = append(opts, middleware.WithRateLimit(apiCfg.rateLimit, apiCfg.rateLimitPerRoute))
+	}
+	if apiCfg.maxConcurrent > 0 {
+		opts = append(opts, middleware.WithMaxConcurrent(apiCfg.maxConcurrent, apiCfg.maxConcurrentWait))
+	}
+	if apiCfg.accessLog {
+		opts = append(opts, middleware.WithAccessLog())
+	}
+	if apiCfg.gzip {
+		opts = append(opts, middleware.WithGzip())
+	}
+	if apiCfg.maxBodyBytes > 0 {
+		opts = append(opts, middleware.WithMaxBodyBytes(apiCfg.maxBodyBytes))
+	}
+	instr, err := middleware.NewMiddleware(meter, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating HTTP middleware: %w", err)
+	}
+
+	var background *backgroundTaskMetrics
+	if backgroundEnabled {
+		background, err = newBackgroundTaskMetrics(meter, startTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var shuttingDown atomic.Bool
+
+	clientDurations, err := meter.Float64Histogram(
+		"http.client.request.duration",
+		metric.WithDescription("Duration of outgoing HTTP requests."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(middleware.DefaultDurationBuckets...),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating client request duration histogram: %w", err)
+	}
+
+	registers := []func() error{
+		func() error { return registerRuntimeMetrics(meter) },
+		func() error { return registerProcessStartTime(meter, startTime) },
+		func() error { return registerProcessRestart(meter) },
+		func() error { return registerBuildInfo(meter) },
+		func() error { return registerShuttingDown(meter, &shuttingDown) },
+	}
+	if !apiCfg.nativeHistogram {
+		buckets := apiCfg.durationBuckets
+		if len(buckets) == 0 {
+			buckets = middleware.DefaultDurationBuckets
+		}
+		registers = append(registers, func() error { return registerDurationBucketsInfo(meter, buckets) })
+	}
+	for _, register := range registers {
+		if err := register(); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &metrics{
+		http:         instr,
+		background:   background,
+		shuttingDown: &shuttingDown,
+		clientTransport: instrumentedTransport{
+			next:      http.DefaultTransport,
+			durations: clientDurations,
+		},
+		instruments: rec.instruments,
+	}
+	return m, nil
+}
+
+// discouragedUnits maps commonly used units that aren't UCUM units to the
+// ones that OpenTelemetry expects instead.
+var discouragedUnits = map[string]string{
+	"seconds":      "s",
+	"second":       "s",
+	"sec":          "s",
+	"milliseconds": "ms",
+	"bytes":        "By",
+	"byte":         "By",
+	"b":            "By",
+	"requests":     "{request}",
+}
+
+// validateInstruments logs a warning for every instrument whose name or unit
+// doesn't follow the OpenTelemetry naming rules, since such instruments are
+// either rejected or mangled on export. It returns the number of problems.
+func (m *metrics) validateInstruments() int {
+	var problems int
+	for _, i := range m.instruments {
+		if !instrumentNameRE.MatchString(i.Name) {
+			slog.Warn("Instrument name does not follow the OpenTelemetry naming rules.", "instrument", i.Name)
+			problems++
+		}
+		if len(i.Unit) > 63 || strings.ContainsFunc(i.Unit, func(r rune) bool { return r < 0x20 || r > 0x7e }) {
+			slog.Warn("Instrument unit must be at most 63 printable ASCII characters.", "instrument", i.Name, "unit", i.Unit)
+			problems++
+		} else if want, ok := discouragedUnits[strings.ToLower(i.Unit)]; ok {
+			slog.Warn("Instrument unit is not a UCUM unit.", "instrument", i.Name, "unit", i.Unit, "suggested_unit", want)
+			problems++
+		}
+	}
+	return problems
+}
+
+// logRegisteredMetrics logs all instruments in a single message, to show what
+// will be exported.
+func (m *metrics) logRegisteredMetrics() {
+	slog.Info("Registered metrics.", "count", len(m.instruments), "instruments", m.instruments)
+}
+
+// instrumentInfo describes a created instrument. Its fields are exported for
+// logging it as JSON.
+type instrumentInfo struct {
+	Name        string `json:"name"`
+	Kind        string `json:"kind"`
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// recordingMeter remembers the name and unit of every instrument that is
+// created through it.
+type recordingMeter struct {
+	metric.Meter
+	instruments []instrumentInfo
+}
+
+func (m *recordingMeter) record(name, kind string, cfg interface {
+	Unit() string
+	Description() string
+}) {
+	m.instruments = append(m.instruments, instrumentInfo{
+		Name:        name,
+		Kind:        kind,
+		Unit:        cfg.Unit(),
+		Description: cfg.Description(),
+	})
+}
+
+func (m *recordingMeter) Int64Counter(name string, opts ...metric.Int64CounterOption) (metric.Int64Counter, error) {
+	m.record(name, "Int64Counter", metric.NewInt64CounterConfig(opts...))
+	return m.Meter.Int64Counter(name, opts...)
+}
+
+func (m *recordingMeter) Int64UpDownCounter(name string, opts ...metric.Int64UpDownCounterOption) (metric.Int64UpDownCounter, error) {
+	m.record(name, "Int64UpDownCounter", metric.NewInt64UpDownCounterConfig(opts...))
+	return m.Meter.Int64UpDownCounter(name, opts...)
+}
+
+func (m *recordingMeter) Int64Histogram(name string, opts ...metric.Int64HistogramOption) (metric.Int64Histogram, error) {
+	m.record(name, "Int64Histogram", metric.NewInt64HistogramConfig(opts...))
+	return m.Meter.Int64Histogram(name, opts...)
+}
+
+func (m *recordingMeter) Int64Gauge(name string, opts ...metric.Int64GaugeOption) (metric.Int64Gauge, error) {
+	m.record(name, "Int64Gauge", metric.NewInt64GaugeConfig(opts...))
+	return m.Meter.Int64Gauge(name, opts...)
+}
+
+func (m *recordingMeter) Int64ObservableCounter(name string, opts ...metric.Int64ObservableCounterOption) (metric.Int64ObservableCounter, error) {
+	m.record(name, "Int64ObservableCounter", metric.NewInt64ObservableCounterConfig(opts...))
+	return m.Meter.Int64ObservableCounter(name, opts...)
+}
+
+func (m *recordingMeter) Int64ObservableUpDownCounter(name string, opts ...metric.Int64ObservableUpDownCounterOption) (metric.Int64ObservableUpDownCounter, error) {
+	m.record(name, "Int64ObservableUpDownCounter", metric.NewInt64ObservableUpDownCounterConfig(opts...))
+	return m.Meter.Int64ObservableUpDownCounter(name, opts...)
+}
+
+func (m *recordingMeter) Int64ObservableGauge(name string, opts ...metric.Int64ObservableGaugeOption) (metric.Int64ObservableGauge, error) {
+	m.record(name, "Int64ObservableGauge", metric.NewInt64ObservableGaugeConfig(opts...))
+	return m.Meter.Int64ObservableGauge(name, opts...)
+}
+
+func (m *recordingMeter) Float64Counter(name string, opts ...metric.Float64CounterOption) (metric.Float64Counter, error) {
+	m.record(name, "Float64Counter", metric.NewFloat64CounterConfig(opts...))
+	return m.Meter.Float64Counter(name, opts...)
+}
+
+func (m *recordingMeter) Float64UpDownCounter(name string, opts ...metric.Float64UpDownCounterOption) (metric.Float64UpDownCounter, error) {
+	m.record(name, "Float64UpDownCounter", metric.NewFloat64UpDownCounterConfig(opts...))
+	return m.Meter.Float64UpDownCounter(name, opts...)
+}
+
+func (m *recordingMeter) Float64Histogram(name string, opts ...metric.Float64HistogramOption) (metric.Float64Histogram, error) {
+	m.record(name, "Float64Histogram", metric.NewFloat64HistogramConfig(opts...))
+	return m.Meter.Float64Histogram(name, opts...)
+}
+
+func (m *recordingMeter) Float64Gauge(name string, opts ...metric.Float64GaugeOption) (metric.Float64Gauge, error) {
+	m.record(name, "Float64Gauge", metric.NewFloat64GaugeConfig(opts...))
+	return m.Meter.Float64Gauge(name, opts...)
+}
+
+func (m *recordingMeter) Float64ObservableCounter(name string, opts ...metric.Float64ObservableCounterOption) (metric.Float64ObservableCounter, error) {
+	m.record(name, "Float64ObservableCounter", metric.NewFloat64ObservableCounterConfig(opts...))
+	return m.Meter.Float64ObservableCounter(name, opts...)
+}
+
+func (m *recordingMeter) Float64ObservableUpDownCounter(name string, opts ...metric.Float64ObservableUpDownCounterOption) (metric.Float64ObservableUpDownCounter, error) {
+	m.record(name, "Float64ObservableUpDownCounter", metric.NewFloat64ObservableUpDownCounterConfig(opts...))
+	return m.Meter.Float64ObservableUpDownCounter(name, opts...)
+}
+
+func (m *recordingMeter) Float64ObservableGauge(name string, opts ...metric.Float64ObservableGaugeOption) (metric.Float64ObservableGauge, error) {
+	m.record(name, "Float64ObservableGauge", metric.NewFloat64ObservableGaugeConfig(opts...))
+	return m.Meter.Float64ObservableGauge(name, opts...)
+}
+
+type demoAPI struct {
+	cfg    demoAPIConfig
+	instr  func(http.Handler) http.Handler
+	client *http.Client
+}
+
+// newDemoAPI creates the demo API, which records its requests with the
+// given metrics.
+func newDemoAPI(m *metrics, cfg demoAPIConfig) *demoAPI {
+	return &demoAPI{
+		cfg:    cfg,
+		instr:  m.http,
+		client: &http.Client{Transport: m.clientTransport},
+	}
+}
+
+// newDemoAPIWithMeterProvider is like newDemoAPI, but creates the metrics
+// with a meter from the given MeterProvider instead of the global one, e.g. to
+// collect the recorded metrics with a ManualReader in tests.
+func newDemoAPIWithMeterProvider(mp metric.MeterProvider, cfg demoAPIConfig) (*demoAPI, error) {
+	m, err := newMetrics(mp.Meter(defaultMeterName, metric.WithInstrumentationVersion(instrumentationVersion())), cfg, false, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("creating metrics: %w", err)
+	}
+	return newDemoAPI(m, cfg), nil
+}
 
 func (a demoAPI) register(mux *http.ServeMux) {
-	mux.HandleFunc("/api/foo", a.foo)
-	mux.HandleFunc("/api/bar", a.bar)
+	mux.Handle("/api/foo", a.wrap(a.foo))
+	mux.Handle("/api/bar", a.wrap(a.bar))
+	// Count requests for unknown paths too, under a single route label.
+	mux.Handle("/", withRoute("<not_found>", a.instr(http.NotFoundHandler())))
+}
+
+// withRoute overrides the pattern of requests passed to next, which the
+// instrumentation uses as the http.route attribute.
+func withRoute(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(r.Context())
+		r.Pattern = route
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wrap applies the request timeout and instrumentation to an API handler. The
+// timeout is applied inside the instrumentation, so that timed out requests
+// are recorded with their 503 status code. The request's context gets the same
+// deadline outside of the instrumentation, so that it can tell timeouts apart
+// from other failures.
+func (a demoAPI) wrap(handler http.HandlerFunc) http.Handler {
+	if a.cfg.timeout <= 0 {
+		return a.instr(handler)
+	}
+	h := a.instr(http.TimeoutHandler(handler, a.cfg.timeout, "Request timed out"))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), a.cfg.timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 func (a demoAPI) foo(w http.ResponseWriter, r *http.Request) {
-	log.Println("Handling foo...")
+	slog.InfoContext(r.Context(), "Handling foo...")
 
 	// Simulate a random duration that the "foo" operation needs to be completed.
-	time.Sleep(25*time.Millisecond + time.Duration(rand.Float64()*150)*time.Millisecond)
+	if err := simulateWork(r.Context(), a.cfg.extraLatency+25*time.Millisecond+time.Duration(rand.Float64()*150)*time.Millisecond); err != nil {
+		slog.InfoContext(r.Context(), "Request cancelled while handling foo.", "err", err)
+		return
+	}
+
+	if a.cfg.downstreamURL != "" {
+		if err := a.callDownstream(r.Context()); err != nil {
+			slog.WarnContext(r.Context(), "Downstream request failed.", "url", a.cfg.downstreamURL, "err", err)
+			http.Error(w, "Downstream request failed", http.StatusBadGateway)
+			return
+		}
+	}
+
+	if a.simulateError(w) {
+		return
+	}
 
 	w.Write([]byte("Handled foo"))
 }
 
 func (a demoAPI) bar(w http.ResponseWriter, r *http.Request) {
-	log.Println("Handling bar...")
+	slog.InfoContext(r.Context(), "Handling bar...")
 	// Simulate a random duration that the "bar" operation needs to be completed.
-	time.Sleep(50*time.Millisecond + time.Duration(rand.Float64()*200)*time.Millisecond)
+	if err := simulateWork(r.Context(), a.cfg.extraLatency+50*time.Millisecond+time.Duration(rand.Float64()*200)*time.Millisecond); err != nil {
+		slog.InfoContext(r.Context(), "Request cancelled while handling bar.", "err", err)
+		return
+	}
+
+	if a.simulateError(w) {
+		return
+	}
 
 	w.Write([]byte("Handled bar"))
 }
 
-func periodicBackgroundTask() {
-	log.Println("Starting background task loop...")
-	bgTicker := time.NewTicker(5 * time.Second)
+// callDownstream sends a GET request to the configured downstream URL and
+// discards the response body.
+func (a demoAPI) callDownstream(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.cfg.downstreamURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// simulateError fails the request with a 500 with the configured error rate.
+// It returns whether the request was failed.
+func (a demoAPI) simulateError(w http.ResponseWriter) bool {
+	if rand.Float64() >= a.cfg.errorRate {
+		return false
+	}
+	http.Error(w, "Simulated error", http.StatusInternalServerError)
+	return true
+}
+
+// simulateWork simulates work that takes the duration d. It returns early with
+// the context's error if ctx is done first, e.g. because the client went away.
+func simulateWork(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// healthz returns a handler that reports whether the server is ready to
+// receive traffic. It fails once shutdown has begun, so that load balancers
+// stop sending new requests. If exported is not nil, it also fails until the
+// first metrics export has succeeded.
+func healthz(shuttingDown, exported *atomic.Bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown.Load() {
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if exported != nil && !exported.Load() {
+			http.Error(w, "Waiting for first metrics export", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK"))
+	}
+}
+
+// secretHeaderRE matches the names of headers whose values are likely secrets.
+var secretHeaderRE = regexp.MustCompile(`(?i)auth|token|key|secret|password|cookie`)
+
+// configHandler returns a handler that serves the values of all flags in fs as
+// a JSON object, with the values of repeatable flags as lists. Likely secrets
+// are redacted: the values of OTLP headers with names like "Authorization",
+// and the passwords of URLs.
+func configHandler(fs *flag.FlagSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		values := map[string]any{}
+		fs.VisitAll(func(f *flag.Flag) {
+			if sf, ok := f.Value.(*stringsFlag); ok {
+				vs := make([]string, 0, len(*sf))
+				for _, v := range *sf {
+					vs = append(vs, redactFlagValue(f.Name, v))
+				}
+				values[f.Name] = vs
+				return
+			}
+			values[f.Name] = redactFlagValue(f.Name, f.Value.String())
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(values); err != nil {
+			slog.ErrorContext(r.Context(), "Error writing config response.", "err", err)
+		}
+	}
+}
+
+// redactFlagValue returns the value of the named flag with likely secrets
+// replaced by "xxxxx", like url.URL.Redacted does for passwords.
+func redactFlagValue(name, value string) string {
+	if name == "otlp.header" {
+		if k, _, ok := strings.Cut(value, "="); ok && secretHeaderRE.MatchString(k) {
+			return k + "=xxxxx"
+		}
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return value
+}
+
+// backgroundTaskMetrics holds the instruments that are shared by all
+// background tasks. Each task's measurements carry a "task" attribute.
+type backgroundTaskMetrics struct {
+	runs        metric.Int64Counter
+	successes   metric.Int64Counter
+	failures    metric.Int64Counter
+	lastRun     metric.Float64Gauge
+	lastSuccess metric.Float64Gauge
+	duration    metric.Float64Histogram
+	// intervals is the actual time between the starts of successive loop
+	// iterations, which drifts from the configured interval e.g. with jitter,
+	// overruns, or GC pauses.
+	intervals metric.Float64Histogram
+	// consecutiveFailures distinguishes a flaky task from one that keeps
+	// failing, which a failure rate alone does not.
+	consecutiveFailures metric.Int64Gauge
+	circuitOpen         metric.Int64Gauge
+	panics              metric.Int64Counter
+
+	// queueDepths holds each task's number of queued work items, which is
+	// observed by the background_task.queue_depth callback. lastSuccesses
+	// holds the time of each task's last successful run, or the zero time if
+	// it hasn't succeeded yet, in which case staleness counts from startTime.
+	mu            sync.Mutex
+	queueDepths   map[string]float64
+	lastSuccesses map[string]time.Time
+	startTime     time.Time
+}
+
+// trackTask starts reporting the time since the task's last successful run.
+func (m *backgroundTaskMetrics) trackTask(task string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lastSuccesses[task]; !ok {
+		m.lastSuccesses[task] = time.Time{}
+	}
+}
+
+// addQueueDepth changes a task's number of queued work items by delta.
+func (m *backgroundTaskMetrics) addQueueDepth(task string, delta float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queueDepths[task] += delta
+}
+
+// runWork runs a task's work and returns its error. A panic is recovered from
+// and returned as an error, so that the task keeps running.
+func (m *backgroundTaskMetrics) runWork(ctx context.Context, task string, work func(context.Context) error) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			slog.Error("Recovered from panic in background task.", "task", task, "panic", rec)
+			m.panics.Add(context.Background(), 1, metric.WithAttributes(attribute.String("task", task)))
+			err = fmt.Errorf("panic: %v", rec)
+		}
+	}()
+	return work(ctx)
+}
+
+// recordRun updates the metrics of a task run that started at start and
+// returned err.
+func (m *backgroundTaskMetrics) recordRun(task string, start time.Time, err error) {
+	taskAttr := attribute.String("task", task)
+	taskAttrs := metric.WithAttributes(taskAttr)
+	now := time.Now()
+
+	status := "success"
+	if err == nil {
+		m.successes.Add(context.Background(), 1, taskAttrs)
+		m.lastSuccess.Record(context.Background(), float64(now.Unix()), taskAttrs)
+		m.mu.Lock()
+		m.lastSuccesses[task] = now
+		m.mu.Unlock()
+	} else {
+		m.failures.Add(context.Background(), 1, taskAttrs)
+		status = "failure"
+	}
+	m.duration.Record(context.Background(), now.Sub(start).Seconds(), metric.WithAttributes(taskAttr, attribute.String("status", status)))
+	m.runs.Add(context.Background(), 1, taskAttrs)
+	m.lastRun.Record(context.Background(), float64(now.Unix()), taskAttrs)
+}
+
+func newBackgroundTaskMetrics(meter metric.Meter, startTime time.Time) (*backgroundTaskMetrics, error) {
+	runs, err := meter.Int64Counter(
+		"background_task.runs",
+		metric.WithDescription("Total number of background task runs."),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating background task runs counter: %w", err)
+	}
+	// Counting successes directly saves computing runs - failures in queries,
+	// which doesn't work well across counter resets.
+	successes, err := meter.Int64Counter(
+		"background_task.successes",
+		metric.WithDescription("Total number of successful background task runs."),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating background task successes counter: %w", err)
+	}
+	failures, err := meter.Int64Counter(
+		"background_task.failures",
+		metric.WithDescription("Total number of background task failures."),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating background task failures counter: %w", err)
+	}
+	lastRun, err := meter.Float64Gauge(
+		"background_task.last_run.timestamp",
+		metric.WithDescription("Unix timestamp of the last background task run."),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating background task last run gauge: %w", err)
+	}
+	lastSuccess, err := meter.Float64Gauge(
+		"background_task.last_success.timestamp",
+		metric.WithDescription("Unix timestamp of the last successful background task run."),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating background task last success gauge: %w", err)
+	}
+	duration, err := meter.Float64Histogram(
+		"background_task.duration",
+		metric.WithDescription("Duration of background task runs."),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating background task duration histogram: %w", err)
+	}
+	intervals, err := meter.Float64Histogram(
+		"background_task.interval.actual",
+		metric.WithDescription("Actual time between the starts of successive background task loop iterations."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(1, 2.5, 5, 7.5, 10, 15, 20, 30, 60, 120),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating background task interval histogram: %w", err)
+	}
+	consecutiveFailures, err := meter.Int64Gauge(
+		"background_task.consecutive_failures",
+		metric.WithDescription("Number of background task runs that failed in a row since the last success."),
+		metric.WithUnit("{run}"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating background task consecutive failures gauge: %w", err)
+	}
+	circuitOpen, err := meter.Int64Gauge(
+		"background_task.circuit_open",
+		metric.WithDescription("Whether the background task's circuit breaker is open or half-open (1) or closed (0)."),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating background task circuit open gauge: %w", err)
+	}
+	panics, err := meter.Int64Counter(
+		"background_task.panics.total",
+		metric.WithDescription("Total number of panics recovered from in background task runs."),
+		metric.WithUnit("{panic}"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating background task panics counter: %w", err)
+	}
+
+	m := &backgroundTaskMetrics{
+		runs:        runs,
+		successes:   successes,
+		failures:    failures,
+		lastRun:     lastRun,
+		lastSuccess: lastSuccess,
+		duration:    duration,
+		intervals:   intervals,
+
+		consecutiveFailures: consecutiveFailures,
+		circuitOpen:         circuitOpen,
+		panics:              panics,
+
+		queueDepths:   map[string]float64{},
+		lastSuccesses: map[string]time.Time{},
+		startTime:     startTime,
+	}
+
+	// Unlike the other instruments, the queue depth is only read whenever
+	// metrics are collected, rather than recorded by the tasks.
+	_, err = meter.Float64ObservableUpDownCounter(
+		"background_task.queue_depth",
+		metric.WithDescription("Number of work items queued for background tasks."),
+		metric.WithUnit("{item}"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			for task, depth := range m.queueDepths {
+				o.Observe(depth, metric.WithAttributes(attribute.String("task", task)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating background task queue depth counter: %w", err)
+	}
+
+	// This saves alerts from computing time() - last_success.timestamp, which
+	// also doesn't work before the first success.
+	_, err = meter.Float64ObservableGauge(
+		"background_task.seconds_since_last_success",
+		metric.WithDescription("Time since the last successful background task run, or since the process started if there was none."),
+		metric.WithUnit("s"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			for task, t := range m.lastSuccesses {
+				if t.IsZero() {
+					t = m.startTime
+				}
+				o.Observe(time.Since(t).Seconds(), metric.WithAttributes(attribute.String("task", task)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating background task seconds since last success gauge: %w", err)
+	}
+
+	return m, nil
+}
+
+// taskRunner runs a set of named background tasks concurrently.
+type taskRunner struct {
+	tasks []namedTask
+}
+
+type namedTask struct {
+	name string
+	run  func(ctx context.Context)
+}
+
+// register adds a task to the runner. The task should return once ctx is done.
+func (r *taskRunner) register(name string, task func(ctx context.Context)) {
+	r.tasks = append(r.tasks, namedTask{name: name, run: task})
+}
+
+// run starts each registered task in its own goroutine and waits for all of
+// them to return.
+func (r *taskRunner) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range r.tasks {
+		wg.Go(func() {
+			t.run(ctx)
+			slog.Info("Background task stopped.", "task", t.name)
+		})
+	}
+	wg.Wait()
+}
+
+// maxBackgroundTaskWork is the longest time that a simulated background task
+// run can take.
+const maxBackgroundTaskWork = 1500 * time.Millisecond
+
+// errSimulatedFailure is returned by simulateBackgroundWork for failed runs.
+var errSimulatedFailure = errors.New("simulated failure")
+
+// simulateBackgroundWork stands in for the actual work of a background task.
+// It takes a random amount of time and fails with a 30% probability.
+func simulateBackgroundWork(_ context.Context) error {
+	time.Sleep(1*time.Second + time.Duration(rand.Float64()*500)*time.Millisecond)
+	if rand.Float64() > 0.3 {
+		return nil
+	}
+	return errSimulatedFailure
+}
+
+// backgroundTaskConfig holds the scheduling settings of a background task.
+type backgroundTaskConfig struct {
+	interval time.Duration
+	// jitter is the fraction (0..1) of the interval by which each run's start
+	// is randomly moved earlier or later, so that instances don't run in
+	// lockstep.
+	jitter float64
+	// breakerThreshold is the number of consecutive failures after which the
+	// circuit breaker opens and runs are skipped for breakerCooldown. Zero
+	// disables the circuit breaker.
+	breakerThreshold int
+	breakerCooldown  time.Duration
+}
+
+// nextDelay returns the time between the start of one run and the next.
+func (c backgroundTaskConfig) nextDelay() time.Duration {
+	return c.interval + time.Duration((rand.Float64()*2-1)*c.jitter*float64(c.interval))
+}
+
+func periodicBackgroundTask(ctx context.Context, m *backgroundTaskMetrics, name string, cfg backgroundTaskConfig, work func(context.Context) error) {
+	logger := slog.With("task", name)
+	taskAttrs := metric.WithAttributes(attribute.String("task", name))
+
+	if minInterval := time.Duration((1 - cfg.jitter) * float64(cfg.interval)); minInterval < maxBackgroundTaskWork {
+		logger.Warn("Background task interval is shorter than the task's work, runs will be delayed.", "interval", cfg.interval, "jitter", cfg.jitter, "max_work", maxBackgroundTaskWork)
+	}
+
+	logger.Info("Starting background task loop...")
+	m.trackTask(name)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	wait := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		}
+	}
+
+	var (
+		consecutiveFailures int64
+		// openUntil is the end of the circuit breaker's cooldown while it is
+		// open. After that, it is half-open until the next run succeeds.
+		openUntil time.Time
+		// lastStart is the start of the previous loop iteration.
+		lastStart time.Time
+	)
 	for {
-		log.Println("Performing background task...")
-		// Simulate a random duration that the background task needs to be completed.
-		time.Sleep(1*time.Second + time.Duration(rand.Float64()*500)*time.Millisecond)
+		now := time.Now()
+		if !lastStart.IsZero() {
+			m.intervals.Record(context.Background(), now.Sub(lastStart).Seconds(), taskAttrs)
+		}
+		lastStart = now
+
+		timer.Reset(cfg.nextDelay())
+		if time.Now().Before(openUntil) {
+			logger.Info("Circuit breaker is open, skipping background task run.", "open_until", openUntil)
+			if !wait() {
+				return
+			}
+			continue
+		}
+		if !openUntil.IsZero() {
+			logger.Info("Circuit breaker is half-open, trying background task again.")
+		}
 
-		// Simulate the background task either succeeding or failing (with a 30% probability).
-		if rand.Float64() > 0.3 {
-			log.Println("Background task completed successfully.")
+		logger.Info("Performing background task...")
+		start := time.Now()
+		m.addQueueDepth(name, 1)
+		err := m.runWork(ctx, name, work)
+		m.addQueueDepth(name, -1)
+		m.recordRun(name, start, err)
+
+		if err == nil {
+			logger.Info("Background task completed successfully.")
+			consecutiveFailures = 0
+			openUntil = time.Time{}
 		} else {
-			log.Println("Background task failed.")
+			logger.Warn("Background task failed.", "err", err)
+			consecutiveFailures++
+			// A failed half-open run opens the circuit again right away.
+			if cfg.breakerThreshold > 0 && consecutiveFailures >= int64(cfg.breakerThreshold) {
+				openUntil = time.Now().Add(cfg.breakerCooldown)
+				logger.Warn("Opening circuit breaker after consecutive failures.", "consecutive_failures", consecutiveFailures, "cooldown", cfg.breakerCooldown)
+			}
+		}
+		m.consecutiveFailures.Record(context.Background(), consecutiveFailures, taskAttrs)
+		if cfg.breakerThreshold > 0 {
+			var circuitOpen int64
+			if !openUntil.IsZero() {
+				circuitOpen = 1
+			}
+			m.circuitOpen.Record(context.Background(), circuitOpen, taskAttrs)
 		}
 
-		<-bgTicker.C
+		if !wait() {
+			return
+		}
 	}
 }
 
-func main() {
-	listenAddr := flag.String("web.listen-addr", ":8080", "The address to listen on for web requests.")
-	flag.Parse()
+// registerRuntimeMetrics registers observable gauges for basic Go runtime
+// statistics, which are read whenever metrics are collected.
+func registerRuntimeMetrics(meter metric.Meter) error {
+	goroutines, err := meter.Int64ObservableGauge(
+		"runtime.goroutines",
+		metric.WithDescription("Number of goroutines that currently exist."),
+		metric.WithUnit("{goroutine}"),
+	)
+	if err != nil {
+		return fmt.Errorf("creating goroutines gauge: %w", err)
+	}
+	heapInUse, err := meter.Float64ObservableGauge(
+		"runtime.heap.in_use",
+		metric.WithDescription("Bytes in in-use heap spans."),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return fmt.Errorf("creating heap in-use gauge: %w", err)
+	}
+	observed := []metric.Observable{goroutines, heapInUse}
+
+	// Open file descriptors can only be counted via /proc on Linux, so the
+	// gauge doesn't exist elsewhere.
+	var openFDs metric.Int64ObservableGauge
+	if runtime.GOOS == "linux" {
+		openFDs, err = meter.Int64ObservableGauge(
+			"process.open_fds",
+			metric.WithDescription("Number of file descriptors that the process has open."),
+			metric.WithUnit("{file_descriptor}"),
+		)
+		if err != nil {
+			return fmt.Errorf("creating open file descriptors gauge: %w", err)
+		}
+		observed = append(observed, openFDs)
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+
+		o.ObserveInt64(goroutines, int64(runtime.NumGoroutine()))
+		o.ObserveFloat64(heapInUse, float64(ms.HeapInuse))
+		if openFDs != nil {
+			// The count includes the descriptor used for reading the directory.
+			fds, err := os.ReadDir("/proc/self/fd")
+			if err != nil {
+				return fmt.Errorf("reading open file descriptors: %w", err)
+			}
+			o.ObserveInt64(openFDs, int64(len(fds)))
+		}
+		return nil
+	}, observed...)
+	if err != nil {
+		return fmt.Errorf("registering runtime metrics callback: %w", err)
+	}
+	return nil
+}
+
+// registerProcessStartTime registers a gauge reporting the time at which the
+// process started, e.g. for computing the uptime.
+func registerProcessStartTime(meter metric.Meter, startTime time.Time) error {
+	start := float64(startTime.UnixNano()) / 1e9
+	_, err := meter.Float64ObservableGauge(
+		"process.start.time",
+		metric.WithDescription("Unix timestamp of when the process started."),
+		metric.WithUnit("s"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			o.Observe(start)
+			return nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("creating process start time gauge: %w", err)
+	}
+	return nil
+}
+
+// registerProcessRestart registers a counter that is incremented once when the
+// process starts. Summed across restarts, e.g. with increase() in PromQL, it
+// counts how often the service was (re)started.
+func registerProcessRestart(meter metric.Meter) error {
+	restarts, err := meter.Int64Counter(
+		"process.restart",
+		metric.WithDescription("Number of times the process has started."),
+		metric.WithUnit("{restart}"),
+	)
+	if err != nil {
+		return fmt.Errorf("creating process restart counter: %w", err)
+	}
+	restarts.Add(context.Background(), 1)
+	return nil
+}
+
+// registerBuildInfo registers a gauge that is always 1 and carries the build
+// information as attributes, following the common *_build_info pattern.
+func registerBuildInfo(meter metric.Meter) error {
+	attrs := metric.WithAttributes(
+		attribute.String("version", version),
+		attribute.String("revision", revision),
+		attribute.String("go_version", runtime.Version()),
+	)
+	_, err := meter.Int64ObservableGauge(
+		"build.info",
+		metric.WithDescription("Build information about the running program. Always 1."),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(1, attrs)
+			return nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("creating build info gauge: %w", err)
+	}
+	return nil
+}
+
+// instrumentedTransport records the duration of the requests that it sends,
+// and passes on the trace context, so that downstream spans join our traces.
+type instrumentedTransport struct {
+	next      http.RoundTripper
+	durations metric.Float64Histogram
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it was given.
+	req = req.Clone(req.Context())
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", req.URL.Hostname()),
+	}
+	if err != nil {
+		attrs = append(attrs, attribute.String("error.type", "request_failed"))
+	} else {
+		attrs = append(attrs, attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	t.durations.Record(req.Context(), time.Since(start).Seconds(), metric.WithAttributes(attrs...))
+	return resp, err
+}
+
+// registerShuttingDown registers a gauge that is 1 while the server drains
+// in-flight requests before exiting, and 0 before that.
+func registerShuttingDown(meter metric.Meter, shuttingDown *atomic.Bool) error {
+	_, err := meter.Int64ObservableGauge(
+		"app.shutting_down",
+		metric.WithDescription("Whether the server is shutting down (1) or not (0)."),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			var v int64
+			if shuttingDown.Load() {
+				v = 1
+			}
+			o.Observe(v)
+			return nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("creating shutting down gauge: %w", err)
+	}
+	return nil
+}
+
+// registerDurationBucketsInfo registers an info gauge with one series per
+// bucket boundary of the HTTP request duration histogram, so that dashboards
+// can show which boundaries are configured. It isn't registered if the
+// histogram is exported as a native histogram.
+func registerDurationBucketsInfo(meter metric.Meter, buckets []float64) error {
+	attrs := make([]metric.ObserveOption, 0, len(buckets))
+	for _, b := range buckets {
+		attrs = append(attrs, metric.WithAttributes(attribute.String("le", strconv.FormatFloat(b, 'g', -1, 64))))
+	}
+
+	_, err := meter.Int64ObservableGauge(
+		"http.duration.bucket.info",
+		metric.WithDescription("The bucket boundaries of the HTTP request duration histogram, one series with the value 1 per boundary."),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			for _, a := range attrs {
+				o.Observe(1, a)
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("creating duration bucket info gauge: %w", err)
+	}
+	return nil
+}
+
+// otelConfig holds the settings for exporting metrics via OTLP.
+type otelConfig struct {
+	serviceName string
+	// exporter is either "otlp" to push metrics or "prometheus" to expose them
+	// for scraping from promRegistry.
+	exporter       string
+	promRegistry   *prometheus.Registry
+	protocol       string
+	endpoints      []string
+	exportInterval time.Duration
+	headers        map[string]string
+	tracesEndpoint string
+	logsEndpoint   string
+	insecure       bool
+	tlsConfig      *tls.Config
+
+	// retryMaxElapsed is the maximum time to keep retrying a failed export.
+	// Retries are disabled if it is zero.
+	retryMaxElapsed time.Duration
+	// compression is the compression applied to OTLP payloads, "none" or "gzip".
+	compression string
+	// temporality is the aggregation temporality of exported counters and
+	// histograms, "cumulative" or "delta".
+	temporality string
+
+	// nativeHistogram makes the HTTP request duration histogram use an
+	// exponential aggregation, which Prometheus stores as a native histogram.
+	nativeHistogram bool
+	// cardinalityLimit is the maximum number of series of each histogram, such
+	// as the HTTP duration histogram. Zero means no limit.
+	cardinalityLimit int
+	// dropMetrics are the names of instruments that are not exported at all.
+	dropMetrics []string
+	// allowMetrics, if not empty, are the names of the only instruments that
+	// are exported. An instrument that is both allowed and dropped is exported.
+	allowMetrics []string
+	// emitSumCounter additionally exports the sum of the HTTP request duration
+	// histogram as a separate http.server.request.duration.sum counter, for
+	// backends that don't handle histogram sums well.
+	emitSumCounter bool
+	// renameMetrics maps instrument names to the names to export them under.
+	renameMetrics map[string]string
+	// environment is the deployment environment, e.g. "production", which is
+	// always a resource attribute. If environmentOnMetrics is set, it is also
+	// added to every metric.
+	environment          string
+	environmentOnMetrics bool
+	// dryRun replaces the exporter with a reader whose metrics are printed to
+	// stdout at every export interval, so that no backend is needed.
+	dryRun bool
+	// fastExportInterval is the export interval of the background task
+	// metrics, which are then exported separately from all other metrics.
+	// Zero means that all metrics are exported at exportInterval.
+	fastExportInterval time.Duration
+	// exported is set once the first OTLP metrics export has succeeded.
+	exported *atomic.Bool
+}
+
+// defaultOTLPEndpoint is the metrics endpoint if no --otlp.endpoint is given,
+// which is Prometheus' OTLP receiver.
+const defaultOTLPEndpoint = "http://localhost:9090/api/v1/otlp/v1/metrics"
 
-	go periodicBackgroundTask()
+// defaultOTLPGRPCEndpoint is the metrics endpoint for --otlp.protocol=grpc if
+// no --otlp.endpoint is given. Prometheus only receives OTLP over HTTP, so this
+// is the standard OTLP/gRPC port of e.g. an OpenTelemetry Collector.
+const defaultOTLPGRPCEndpoint = "http://localhost:4317"
 
-	api := &demoAPI{}
-	api.register(http.DefaultServeMux)
+// newOTLPHTTPClient creates the HTTP client used by the OTLP/HTTP metrics
+// exporter. Providing our own client lets us observe individual export
+// attempts, which the exporter otherwise retries silently.
+func newOTLPHTTPClient(cfg otelConfig, endpoint string) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !cfg.insecure && cfg.tlsConfig != nil {
+		transport.TLSClientConfig = cfg.tlsConfig
+	}
+	if socketPath, ok := unixSocketPath(endpoint); ok {
+		// Connect to the socket no matter what host the exporter asks for.
+		var dialer net.Dialer
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+	return &http.Client{
+		Transport: retryLoggingTransport{next: transport},
+		Timeout:   10 * time.Second,
+	}
+}
+
+// retryLoggingTransport logs OTLP export attempts that failed in a way that
+// the exporter will retry.
+type retryLoggingTransport struct {
+	next http.RoundTripper
+}
+
+func (t retryLoggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		slog.Debug("OTLP export attempt failed, retrying if possible.", "url", req.URL.String(), "err", err)
+		return resp, err
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		slog.Debug("OTLP export attempt failed, retrying if possible.", "url", req.URL.String(), "status", resp.Status)
+	}
+	return resp, nil
+}
+
+// logRetryInterceptor logs OTLP/gRPC export attempts that failed in a way that
+// the exporter will retry, like retryLoggingTransport does for OTLP/HTTP.
+func logRetryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+		slog.Debug("OTLP export attempt failed, retrying if possible.", "target", cc.Target(), "err", err)
+	}
+	return err
+}
 
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+// unixSocketPath returns the socket path of an endpoint of the form
+// unix:///path/to.sock, which is used to reach a collector that listens on a
+// Unix domain socket, e.g. in a sidecar.
+func unixSocketPath(endpoint string) (string, bool) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "unix" || u.Path == "" {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// newTLSConfig returns a TLS configuration that trusts the CA certificates
+// in the given PEM file in addition to the system's root CAs.
+func newTLSConfig(caFile string) (*tls.Config, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no valid PEM certificates found in CA file %q", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// newMetricExporter creates a metrics exporter for the configured protocol,
+// which pushes to the given endpoint. Besides OTLP, the "stdout" protocol
+// prints metrics to standard output for local debugging without a running
+// backend.
+func newMetricExporter(ctx context.Context, cfg otelConfig, endpoint string) (sdk_metric.Exporter, error) {
+	httpCompression := otlpmetrichttp.NoCompression
+	if cfg.compression == "gzip" {
+		httpCompression = otlpmetrichttp.GzipCompression
+	}
+
+	temporalitySelector := sdk_metric.DefaultTemporalitySelector
+	if cfg.temporality == "delta" {
+		temporalitySelector = deltaTemporalitySelector
+	}
+
+	socketPath, overUnixSocket := unixSocketPath(endpoint)
+
+	switch cfg.protocol {
+	case "http":
+		opts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithHeaders(cfg.headers),
+			otlpmetrichttp.WithHTTPClient(newOTLPHTTPClient(cfg, endpoint)),
+			otlpmetrichttp.WithCompression(httpCompression),
+			otlpmetrichttp.WithTemporalitySelector(temporalitySelector),
+			otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig{
+				Enabled:         cfg.retryMaxElapsed > 0,
+				InitialInterval: time.Second,
+				MaxInterval:     10 * time.Second,
+				MaxElapsedTime:  cfg.retryMaxElapsed,
+			}),
+		}
+		if overUnixSocket {
+			// The HTTP client dials the socket, so the host name only ends up in
+			// the Host header. Requests are sent to the default /v1/metrics path.
+			opts = append(opts, otlpmetrichttp.WithEndpoint("localhost"), otlpmetrichttp.WithInsecure())
+		} else {
+			opts = append(opts, otlpmetrichttp.WithEndpointURL(endpoint))
+		}
+		if cfg.insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	case "grpc":
+		opts := []otlpmetricgrpc.Option{
+			otlpmetricgrpc.WithHeaders(cfg.headers),
+			otlpmetricgrpc.WithTemporalitySelector(temporalitySelector),
+			otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetryConfig{
+				Enabled:         cfg.retryMaxElapsed > 0,
+				InitialInterval: time.Second,
+				MaxInterval:     10 * time.Second,
+				MaxElapsedTime:  cfg.retryMaxElapsed,
+			}),
+			otlpmetricgrpc.WithDialOption(grpc.WithUnaryInterceptor(logRetryInterceptor)),
+		}
+		if cfg.compression == "gzip" {
+			opts = append(opts, otlpmetricgrpc.WithCompressor("gzip"))
+		}
+		if overUnixSocket {
+			// gRPC resolves unix:// targets itself.
+			opts = append(opts, otlpmetricgrpc.WithEndpoint("unix://"+socketPath))
+		} else {
+			opts = append(opts, otlpmetricgrpc.WithEndpointURL(endpoint))
+		}
+		if cfg.insecure || overUnixSocket {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		} else if cfg.tlsConfig != nil {
+			opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(cfg.tlsConfig)))
+		}
+		exporter, err := otlpmetricgrpc.New(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		// Unlike with OTLP/HTTP, we can't observe the individual attempts of the
+		// gRPC client, so log changes of the overall export results instead.
+		return &stateLoggingExporter{Exporter: exporter, endpoint: endpoint}, nil
+	case "stdout":
+		return stdoutmetric.New(stdoutmetric.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q", cfg.protocol)
+	}
+}
+
+// stateLoggingExporter wraps an Exporter to log when exports start failing and
+// when they succeed again, rather than every failed export.
+type stateLoggingExporter struct {
+	sdk_metric.Exporter
+	endpoint string
+
+	mu sync.Mutex
+	// failingSince is the time of the first failed export since the last
+	// successful one, or zero while exports succeed.
+	failingSince time.Time
+	failures     int
+}
+
+func (e *stateLoggingExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	err := e.Exporter.Export(ctx, rm)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case err != nil && e.failingSince.IsZero():
+		slog.Warn("OTLP metrics exports started failing.", "endpoint", e.endpoint, "err", err)
+		e.failingSince = time.Now()
+		e.failures = 1
+	case err != nil:
+		e.failures++
+	case !e.failingSince.IsZero():
+		slog.Info("OTLP metrics exports are succeeding again.", "endpoint", e.endpoint, "failed_exports", e.failures, "failing_for", time.Since(e.failingSince))
+		e.failingSince = time.Time{}
+		e.failures = 0
+	}
+	return err
+}
+
+// exportNotifyingExporter wraps an Exporter to record whether an export has
+// succeeded yet.
+type exportNotifyingExporter struct {
+	sdk_metric.Exporter
+	exported *atomic.Bool
+}
+
+func (e exportNotifyingExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	err := e.Exporter.Export(ctx, rm)
+	if err == nil && !e.exported.Swap(true) {
+		slog.Info("First metrics export succeeded.")
+	}
+	return err
+}
+
+// fastMetricPrefix is the name prefix of the instruments that are exported at
+// the fast export interval, if one is configured.
+const fastMetricPrefix = "background_task."
+
+func isFastMetric(name string) bool {
+	return strings.HasPrefix(name, fastMetricPrefix)
+}
+
+// filteringExporter wraps an Exporter to only export the metrics whose
+// (exported) name is accepted by keep.
+type filteringExporter struct {
+	sdk_metric.Exporter
+	keep func(name string) bool
+}
+
+func (e filteringExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	filtered := *rm
+	filtered.ScopeMetrics = make([]metricdata.ScopeMetrics, 0, len(rm.ScopeMetrics))
+	for _, sm := range rm.ScopeMetrics {
+		var metrics []metricdata.Metrics
+		for _, m := range sm.Metrics {
+			if e.keep(m.Name) {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) > 0 {
+			sm.Metrics = metrics
+			filtered.ScopeMetrics = append(filtered.ScopeMetrics, sm)
+		}
+	}
+	return e.Exporter.Export(ctx, &filtered)
+}
+
+// attributeAddingExporter wraps an Exporter to add an attribute to every
+// exported data point, for backends that don't turn resource attributes into
+// labels by themselves.
+type attributeAddingExporter struct {
+	sdk_metric.Exporter
+	attr attribute.KeyValue
+}
+
+func (e attributeAddingExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	for _, sm := range rm.ScopeMetrics {
+		for i := range sm.Metrics {
+			switch data := sm.Metrics[i].Data.(type) {
+			case metricdata.Sum[int64]:
+				addAttr(data.DataPoints, e.attr)
+			case metricdata.Sum[float64]:
+				addAttr(data.DataPoints, e.attr)
+			case metricdata.Gauge[int64]:
+				addAttr(data.DataPoints, e.attr)
+			case metricdata.Gauge[float64]:
+				addAttr(data.DataPoints, e.attr)
+			case metricdata.Histogram[int64]:
+				addHistogramAttr(data.DataPoints, e.attr)
+			case metricdata.Histogram[float64]:
+				addHistogramAttr(data.DataPoints, e.attr)
+			case metricdata.ExponentialHistogram[int64]:
+				addExponentialHistogramAttr(data.DataPoints, e.attr)
+			case metricdata.ExponentialHistogram[float64]:
+				addExponentialHistogramAttr(data.DataPoints, e.attr)
+			}
+		}
+	}
+	return e.Exporter.Export(ctx, rm)
+}
+
+func withAttr(set attribute.Set, attr attribute.KeyValue) attribute.Set {
+	return attribute.NewSet(append(set.ToSlice(), attr)...)
+}
+
+func addAttr[N int64 | float64](dps []metricdata.DataPoint[N], attr attribute.KeyValue) {
+	for i := range dps {
+		dps[i].Attributes = withAttr(dps[i].Attributes, attr)
+	}
+}
+
+func addHistogramAttr[N int64 | float64](dps []metricdata.HistogramDataPoint[N], attr attribute.KeyValue) {
+	for i := range dps {
+		dps[i].Attributes = withAttr(dps[i].Attributes, attr)
+	}
+}
+
+func addExponentialHistogramAttr[N int64 | float64](dps []metricdata.ExponentialHistogramDataPoint[N], attr attribute.KeyValue) {
+	for i := range dps {
+		dps[i].Attributes = withAttr(dps[i].Attributes, attr)
+	}
+}
+
+// deltaTemporalitySelector uses delta temporality for counters and
+// histograms. Up-down counters stay cumulative, since their deltas are not
+// meaningful on their own.
+func deltaTemporalitySelector(kind sdk_metric.InstrumentKind) metricdata.Temporality {
+	switch kind {
+	case sdk_metric.InstrumentKindCounter,
+		sdk_metric.InstrumentKindHistogram,
+		sdk_metric.InstrumentKindObservableCounter:
+		return metricdata.DeltaTemporality
+	default:
+		return metricdata.CumulativeTemporality
+	}
+}
+
+// newResource describes this service instance, so that metrics from several
+// instances can be told apart in the backend.
+func newResource(serviceName, environment string) (*resource.Resource, error) {
+	instanceID, err := os.Hostname()
+	if err != nil || instanceID == "" {
+		instanceID = uuid.NewString()
+	}
+
+	return resource.Merge(
+		resource.Default(),
+		resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(version),
+			semconv.ServiceInstanceID(instanceID),
+			attribute.String("deployment.environment", environment),
+		),
+	)
+}
+
+// printingReader is a ManualReader whose metrics are printed to stdout. Unlike
+// a plain ManualReader, it also prints them on ForceFlush, so that the final
+// flush on shutdown prints the metrics of the last interval.
+type printingReader struct {
+	*sdk_metric.ManualReader
+	exporter sdk_metric.Exporter
+	// mu keeps the periodic and the final print from interleaving.
+	mu sync.Mutex
+}
+
+func newPrintingReader(opts ...sdk_metric.ManualReaderOption) (*printingReader, error) {
+	exporter, err := stdoutmetric.New(stdoutmetric.WithPrettyPrint())
+	if err != nil {
+		return nil, fmt.Errorf("creating stdout metrics exporter: %w", err)
+	}
+	return &printingReader{ManualReader: sdk_metric.NewManualReader(opts...), exporter: exporter}, nil
+}
+
+// ForceFlush collects and prints the metrics.
+func (r *printingReader) ForceFlush(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var rm metricdata.ResourceMetrics
+	if err := r.Collect(ctx, &rm); err != nil {
+		return fmt.Errorf("collecting metrics: %w", err)
+	}
+	if err := r.exporter.Export(ctx, &rm); err != nil {
+		return fmt.Errorf("printing metrics: %w", err)
+	}
+	return nil
+}
+
+// printMetrics prints the metrics of reader at every interval, until ctx is
+// cancelled.
+func printMetrics(ctx context.Context, reader *printingReader, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := reader.ForceFlush(ctx); err != nil {
+			slog.Error("Error printing metrics.", "err", err)
+		}
+	}
+}
+
+// newPeriodicReaders creates the readers that periodically push metrics to
+// endpoint. Each endpoint has its own readers, which export independently of
+// those of other endpoints.
+func newPeriodicReaders(ctx context.Context, cfg otelConfig, endpoint string) ([]sdk_metric.Reader, error) {
+	exporter, err := newMetricExporter(ctx, cfg, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP metrics exporter for %s: %w", endpoint, err)
+	}
+	if cfg.environmentOnMetrics {
+		exporter = attributeAddingExporter{Exporter: exporter, attr: attribute.String("deployment.environment", cfg.environment)}
+	}
+	if cfg.exported != nil {
+		exporter = exportNotifyingExporter{Exporter: exporter, exported: cfg.exported}
+	}
+
+	if cfg.fastExportInterval <= 0 {
+		return []sdk_metric.Reader{sdk_metric.NewPeriodicReader(exporter,
+			sdk_metric.WithInterval(cfg.exportInterval),
+			histogramCardinalityLimit(cfg.cardinalityLimit),
+		)}, nil
+	}
+
+	// Views apply to all readers alike, so instead of routing instruments to
+	// a reader, each reader's exporter drops the other reader's instruments.
+	fastExporter, err := newMetricExporter(ctx, cfg, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("creating fast OTLP metrics exporter for %s: %w", endpoint, err)
+	}
+	if cfg.environmentOnMetrics {
+		fastExporter = attributeAddingExporter{Exporter: fastExporter, attr: attribute.String("deployment.environment", cfg.environment)}
+	}
+	return []sdk_metric.Reader{
+		sdk_metric.NewPeriodicReader(
+			filteringExporter{Exporter: exporter, keep: func(name string) bool { return !isFastMetric(name) }},
+			sdk_metric.WithInterval(cfg.exportInterval),
+			histogramCardinalityLimit(cfg.cardinalityLimit),
+		),
+		sdk_metric.NewPeriodicReader(
+			filteringExporter{Exporter: fastExporter, keep: isFastMetric},
+			sdk_metric.WithInterval(cfg.fastExportInterval),
+			histogramCardinalityLimit(cfg.cardinalityLimit),
+		),
+	}, nil
+}
+
+// histogramCardinalityLimit returns a reader option that limits the number of
+// series of each histogram, most importantly the HTTP duration histogram, whose
+// routes are chosen by clients. Series beyond the limit are folded into a
+// single series with the otel.metric.overflow="true" attribute. All other
+// instruments keep the SDK's default limit.
+func histogramCardinalityLimit(limit int) sdk_metric.ReaderOption {
+	return sdk_metric.WithCardinalityLimitSelector(func(kind sdk_metric.InstrumentKind) (int, bool) {
+		if kind == sdk_metric.InstrumentKindHistogram {
+			return limit, false
+		}
+		return 0, true
+	})
+}
+
+// setupOtel configures a global OpenTelemetry MeterProvider that periodically
+// pushes metrics to an OTLP receiver (by default Prometheus), or that exposes
+// them for scraping if the "prometheus" exporter is configured. It returns the
+// provider, which the caller needs to shut down.
+func setupOtel(ctx context.Context, cfg otelConfig) (*sdk_metric.MeterProvider, error) {
+	var readers []sdk_metric.Reader
+	switch {
+	case cfg.dryRun:
+		reader, err := newPrintingReader(histogramCardinalityLimit(cfg.cardinalityLimit))
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, reader)
+		go printMetrics(ctx, reader, cfg.exportInterval)
+	case cfg.exporter == "prometheus":
+		opts := []prometheus_exporter.Option{prometheus_exporter.WithRegisterer(cfg.promRegistry)}
+		if cfg.environmentOnMetrics {
+			opts = append(opts, prometheus_exporter.WithResourceAsConstantLabels(attribute.NewAllowKeysFilter("deployment.environment")))
+		}
+		exporter, err := prometheus_exporter.New(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("creating Prometheus exporter: %w", err)
+		}
+		readers = append(readers, exporter)
+	default:
+		endpoints := cfg.endpoints
+		if cfg.protocol == "stdout" {
+			// All exporters would print to the same output.
+			endpoints = endpoints[:1]
+		}
+		for _, endpoint := range endpoints {
+			rs, err := newPeriodicReaders(ctx, cfg, endpoint)
+			if err != nil {
+				return nil, err
+			}
+			readers = append(readers, rs...)
+		}
+	}
+
+	res, err := newResource(cfg.serviceName, cfg.environment)
+	if err != nil {
+		return nil, fmt.Errorf("creating OpenTelemetry resource: %w", err)
+	}
+
+	opts := []sdk_metric.Option{
+		sdk_metric.WithResource(res),
+		sdk_metric.WithView(metricViews(cfg)...),
+		// Only keep exemplars for measurements that were recorded within a sampled
+		// span, so that every exported exemplar links to an existing trace.
+		sdk_metric.WithExemplarFilter(exemplar.TraceBasedFilter),
+	}
+	for _, r := range readers {
+		opts = append(opts, sdk_metric.WithReader(r))
+	}
+	meterProvider := sdk_metric.NewMeterProvider(opts...)
+	otel.SetMeterProvider(meterProvider)
+	return meterProvider, nil
+}
+
+// metricViews returns the views that apply --http.native-histogram,
+// --metrics.rename, --metrics.emit-sum-counter, --metrics.drop and
+// --metrics.allow.
+func metricViews(cfg otelConfig) []sdk_metric.View {
+	// Every matching view produces its own stream, so collect all changes to an
+	// instrument into a single view.
+	streams := map[string]sdk_metric.Stream{}
+	if cfg.nativeHistogram {
+		s := streams["http.server.request.duration"]
+		s.Aggregation = sdk_metric.AggregationBase2ExponentialHistogram{MaxSize: 160, MaxScale: 20}
+		streams["http.server.request.duration"] = s
+	}
+	for oldName, newName := range cfg.renameMetrics {
+		s := streams[oldName]
+		s.Name = newName
+		streams[oldName] = s
+	}
+	if cfg.emitSumCounter {
+		// Make sure that the histogram itself is still exported alongside the
+		// counter view below.
+		streams["http.server.request.duration"] = streams["http.server.request.duration"]
+	}
+	// Views select instruments by their original name, so allow and drop
+	// renamed instruments by either name.
+	instrumentNames := make(map[string]string, len(cfg.renameMetrics))
+	for oldName, newName := range cfg.renameMetrics {
+		instrumentNames[newName] = oldName
+	}
+	instrumentName := func(name string) string {
+		if oldName, ok := instrumentNames[name]; ok {
+			return oldName
+		}
+		return name
+	}
+	allowed := make(map[string]bool, len(cfg.allowMetrics))
+	for _, name := range cfg.allowMetrics {
+		allowed[instrumentName(name)] = true
+	}
+	dropMetrics := make([]string, 0, len(cfg.dropMetrics))
+	for _, name := range cfg.dropMetrics {
+		dropMetrics = append(dropMetrics, instrumentName(name))
+	}
+	for _, name := range dropMetrics {
+		if allowed[name] {
+			continue
+		}
+		s := streams[name]
+		s.Aggregation = sdk_metric.AggregationDrop{}
+		streams[name] = s
+	}
+	views := make([]sdk_metric.View, 0, len(streams)+1)
+	for name, s := range streams {
+		if len(allowed) > 0 && !allowed[name] {
+			s.Aggregation = sdk_metric.AggregationDrop{}
+		}
+		views = append(views, sdk_metric.NewView(sdk_metric.Instrument{Name: name}, s))
+	}
+	// The sum stream is dropped along with the histogram it is derived from,
+	// but can also be allowed or dropped by its own name.
+	dropped := func(name string) bool {
+		return !allowed[name] && slices.Contains(dropMetrics, name)
+	}
+	keepSum := allowed["http.server.request.duration.sum"] ||
+		(len(allowed) == 0 || allowed["http.server.request.duration"]) &&
+			!dropped("http.server.request.duration.sum") && !dropped("http.server.request.duration")
+	if cfg.emitSumCounter && keepSum {
+		views = append(views, sdk_metric.NewView(
+			sdk_metric.Instrument{Name: "http.server.request.duration"},
+			sdk_metric.Stream{Name: "http.server.request.duration.sum", Aggregation: sdk_metric.AggregationSum{}},
+		))
+	}
+	if len(allowed) > 0 {
+		// Drop all instruments that neither are allowed nor already have a view
+		// of their own above.
+		views = append(views, func(i sdk_metric.Instrument) (sdk_metric.Stream, bool) {
+			if _, ok := streams[i.Name]; ok || allowed[i.Name] {
+				return sdk_metric.Stream{}, false
+			}
+			return sdk_metric.Stream{Aggregation: sdk_metric.AggregationDrop{}}, true
+		})
+	}
+	return views
+}
+
+// setupTracing configures a global OpenTelemetry TracerProvider that exports
+// spans via OTLP/HTTP to the configured traces endpoint. It returns a
+// function that flushes and shuts down the provider.
+func setupTracing(ctx context.Context, cfg otelConfig) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpointURL(cfg.tracesEndpoint),
+		otlptracehttp.WithHeaders(cfg.headers),
+	}
+	if cfg.insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	} else if cfg.tlsConfig != nil {
+		opts = append(opts, otlptracehttp.WithTLSClientConfig(cfg.tlsConfig))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP trace exporter: %w", err)
+	}
+
+	res, err := newResource(cfg.serviceName, cfg.environment)
+	if err != nil {
+		return nil, fmt.Errorf("creating OpenTelemetry resource: %w", err)
+	}
+
+	tracerProvider := sdk_trace.NewTracerProvider(
+		sdk_trace.WithResource(res),
+		sdk_trace.WithBatcher(exporter),
+	)
+	otel.SetTracerProvider(tracerProvider)
+
+	return tracerProvider.Shutdown, nil
+}
+
+// parseBuckets parses a comma-separated list of strictly increasing histogram
+// bucket boundaries. An empty string results in no boundaries.
+func parseBuckets(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var buckets []float64
+	for _, f := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket boundary %q: %w", f, err)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("bucket boundaries must be strictly increasing, but %v follows %v", b, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// traceContextHandler is a slog.Handler that adds the trace and span IDs of
+// the span in a record's context, so that logs can be correlated with traces.
+type traceContextHandler struct {
+	slog.Handler
+}
+
+func (h traceContextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceContextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceContextHandler) WithGroup(name string) slog.Handler {
+	return traceContextHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// setupLogs configures a global OpenTelemetry LoggerProvider that exports log
+// records via OTLP/HTTP to the configured logs endpoint. It returns a function
+// that flushes and shuts down the provider.
+func setupLogs(ctx context.Context, cfg otelConfig) (func(context.Context) error, error) {
+	opts := []otlploghttp.Option{
+		otlploghttp.WithEndpointURL(cfg.logsEndpoint),
+		otlploghttp.WithHeaders(cfg.headers),
+	}
+	if cfg.insecure {
+		opts = append(opts, otlploghttp.WithInsecure())
+	} else if cfg.tlsConfig != nil {
+		opts = append(opts, otlploghttp.WithTLSClientConfig(cfg.tlsConfig))
+	}
+	exporter, err := otlploghttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP log exporter: %w", err)
+	}
+
+	res, err := newResource(cfg.serviceName, cfg.environment)
+	if err != nil {
+		return nil, fmt.Errorf("creating OpenTelemetry resource: %w", err)
+	}
+
+	loggerProvider := sdk_log.NewLoggerProvider(
+		sdk_log.WithResource(res),
+		sdk_log.WithProcessor(sdk_log.NewBatchProcessor(exporter)),
+	)
+	global.SetLoggerProvider(loggerProvider)
+
+	return loggerProvider.Shutdown, nil
+}
+
+// levelHandler is a slog.Handler that drops records below a minimum level,
+// for handlers like the OpenTelemetry bridge that don't filter by level.
+type levelHandler struct {
+	slog.Handler
+	level slog.Leveler
+}
+
+func (h levelHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.level.Level() && h.Handler.Enabled(ctx, l)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// setFlagsFromEnv sets every flag that was not set on the command line from
+// the environment variable named after the flag, e.g. OTEL_EX_OTLP_ENDPOINT
+// for --otlp.endpoint with prefix "OTEL_EX_". This runs after parsing the
+// command line, so that flags take precedence even for repeatable flags.
+func setFlagsFromEnv(fs *flag.FlagSet, prefix string) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		name := prefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(f.Name))
+		if v, ok := os.LookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("invalid value %q for environment variable %s: %w", v, name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// instrumentNameRE matches valid OpenTelemetry instrument names.
+var instrumentNameRE = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_./-]{0,254}$`)
+
+// fileConfig is the schema of the --config YAML file. Its options are named
+// and nested like the flags they set, e.g. otlp: {export-interval: 15s} sets
+// --otlp.export-interval.
+type fileConfig struct {
+	Exporter   *string              `yaml:"exporter"`
+	DryRun     *bool                `yaml:"dry-run"`
+	Web        webFileConfig        `yaml:"web"`
+	Service    serviceFileConfig    `yaml:"service"`
+	Deployment deploymentFileConfig `yaml:"deployment"`
+	Meter      meterFileConfig      `yaml:"meter"`
+	OTLP       otlpFileConfig       `yaml:"otlp"`
+	Demo       demoFileConfig       `yaml:"demo"`
+	HTTP       httpFileConfig       `yaml:"http"`
+	Metrics    metricsFileConfig    `yaml:"metrics"`
+	Background backgroundFileConfig `yaml:"background"`
+	Log        logFileConfig        `yaml:"log"`
+	Debug      debugFileConfig      `yaml:"debug"`
+	Shutdown   shutdownFileConfig   `yaml:"shutdown"`
+}
+
+// webFileConfig holds the web.* options of fileConfig.
+type webFileConfig struct {
+	ListenAddr *string `yaml:"listen-addr"`
+}
+
+// serviceFileConfig holds the service.* options of fileConfig.
+type serviceFileConfig struct {
+	Name *string `yaml:"name"`
+}
+
+// deploymentFileConfig holds the deployment.* options of fileConfig.
+type deploymentFileConfig struct {
+	Environment          *string `yaml:"environment"`
+	EnvironmentOnMetrics *bool   `yaml:"environment-on-metrics"`
+}
+
+// meterFileConfig holds the meter.* options of fileConfig.
+type meterFileConfig struct {
+	Name *string `yaml:"name"`
+}
+
+// otlpFileConfig holds the otlp.* options of fileConfig.
+type otlpFileConfig struct {
+	Protocol        *string           `yaml:"protocol"`
+	Endpoint        []string          `yaml:"endpoint"`
+	ExportInterval  *time.Duration    `yaml:"export-interval"`
+	FastInterval    *time.Duration    `yaml:"fast-interval"`
+	WaitForExport   *bool             `yaml:"wait-for-export"`
+	LogsEndpoint    *string           `yaml:"logs-endpoint"`
+	TracesEndpoint  *string           `yaml:"traces-endpoint"`
+	CAFile          *string           `yaml:"ca-file"`
+	Insecure        *bool             `yaml:"insecure"`
+	RetryMaxElapsed *time.Duration    `yaml:"retry-max-elapsed"`
+	Compression     *string           `yaml:"compression"`
+	Temporality     *string           `yaml:"temporality"`
+	Header          map[string]string `yaml:"header"`
+}
+
+// demoFileConfig holds the demo.* options of fileConfig.
+type demoFileConfig struct {
+	DownstreamURL *string        `yaml:"downstream-url"`
+	ExtraLatency  *time.Duration `yaml:"extra-latency"`
+}
+
+// httpFileConfig holds the http.* options of fileConfig.
+type httpFileConfig struct {
+	Timeout                *time.Duration    `yaml:"timeout"`
+	RateLimitPerRoute      *bool             `yaml:"rate-limit-per-route"`
+	MaxConcurrent          *int              `yaml:"max-concurrent"`
+	MaxConcurrentWait      *time.Duration    `yaml:"max-concurrent-wait"`
+	AccessLog              *bool             `yaml:"access-log"`
+	Gzip                   *bool             `yaml:"gzip"`
+	RecordClientSubnet     *bool             `yaml:"record-client-subnet"`
+	TrustForwarded         *bool             `yaml:"trust-forwarded"`
+	AttributeHeader        map[string]string `yaml:"attribute-header"`
+	AttributeHeaderPattern *string           `yaml:"attribute-header-pattern"`
+	SLOThreshold           *time.Duration    `yaml:"slo-threshold"`
+	DurationBuckets        []float64         `yaml:"duration-buckets"`
+	NativeHistogram        *bool             `yaml:"native-histogram"`
+}
+
+// metricsFileConfig holds the metrics.* options of fileConfig.
+type metricsFileConfig struct {
+	CardinalityLimit *int              `yaml:"cardinality-limit"`
+	Drop             []string          `yaml:"drop"`
+	Allow            []string          `yaml:"allow"`
+	Rename           map[string]string `yaml:"rename"`
+	EmitSumCounter   *bool             `yaml:"emit-sum-counter"`
+}
+
+// backgroundFileConfig holds the background.* options of fileConfig.
+type backgroundFileConfig struct {
+	Enabled          *bool          `yaml:"enabled"`
+	Interval         *time.Duration `yaml:"interval"`
+	BreakerThreshold *int           `yaml:"breaker-threshold"`
+	BreakerCooldown  *time.Duration `yaml:"breaker-cooldown"`
+}
+
+// logFileConfig holds the log.* options of fileConfig.
+type logFileConfig struct {
+	Level *string `yaml:"level"`
+}
+
+// debugFileConfig holds the debug.* options of fileConfig.
+type debugFileConfig struct {
+	ConfigEndpoint *bool `yaml:"config-endpoint"`
+	Pprof          *bool `yaml:"pprof"`
+}
+
+// shutdownFileConfig holds the shutdown.* options of fileConfig.
+type shutdownFileConfig struct {
+	Timeout    *time.Duration `yaml:"timeout"`
+	DrainDelay *time.Duration `yaml:"drain-delay"`
+}
+
+// flagValues returns the values of all options that are set in the config
+// file, keyed by flag name. Repeatable flags can have several values.
+func (c fileConfig) flagValues() map[string][]string {
+	values := map[string][]string{
+		"exporter":                          optionValue(c.Exporter),
+		"dry-run":                           optionValue(c.DryRun),
+		"web.listen-addr":                   optionValue(c.Web.ListenAddr),
+		"service.name":                      optionValue(c.Service.Name),
+		"deployment.environment":            optionValue(c.Deployment.Environment),
+		"deployment.environment-on-metrics": optionValue(c.Deployment.EnvironmentOnMetrics),
+		"meter.name":                        optionValue(c.Meter.Name),
+		"otlp.protocol":                     optionValue(c.OTLP.Protocol),
+		"otlp.endpoint":                     c.OTLP.Endpoint,
+		"otlp.export-interval":              optionValue(c.OTLP.ExportInterval),
+		"otlp.fast-interval":                optionValue(c.OTLP.FastInterval),
+		"otlp.wait-for-export":              optionValue(c.OTLP.WaitForExport),
+		"otlp.logs-endpoint":                optionValue(c.OTLP.LogsEndpoint),
+		"otlp.traces-endpoint":              optionValue(c.OTLP.TracesEndpoint),
+		"otlp.ca-file":                      optionValue(c.OTLP.CAFile),
+		"otlp.insecure":                     optionValue(c.OTLP.Insecure),
+		"otlp.retry-max-elapsed":            optionValue(c.OTLP.RetryMaxElapsed),
+		"otlp.compression":                  optionValue(c.OTLP.Compression),
+		"otlp.temporality":                  optionValue(c.OTLP.Temporality),
+		"otlp.header":                       pairValues(c.OTLP.Header),
+		"demo.downstream-url":               optionValue(c.Demo.DownstreamURL),
+		"demo.extra-latency":                optionValue(c.Demo.ExtraLatency),
+		"http.timeout":                      optionValue(c.HTTP.Timeout),
+		"http.rate-limit-per-route":         optionValue(c.HTTP.RateLimitPerRoute),
+		"http.max-concurrent":               optionValue(c.HTTP.MaxConcurrent),
+		"http.max-concurrent-wait":          optionValue(c.HTTP.MaxConcurrentWait),
+		"http.access-log":                   optionValue(c.HTTP.AccessLog),
+		"http.gzip":                         optionValue(c.HTTP.Gzip),
+		"http.record-client-subnet":         optionValue(c.HTTP.RecordClientSubnet),
+		"http.trust-forwarded":              optionValue(c.HTTP.TrustForwarded),
+		"http.attribute-header":             pairValues(c.HTTP.AttributeHeader),
+		"http.attribute-header-pattern":     optionValue(c.HTTP.AttributeHeaderPattern),
+		"http.slo-threshold":                optionValue(c.HTTP.SLOThreshold),
+		"http.native-histogram":             optionValue(c.HTTP.NativeHistogram),
+		"metrics.cardinality-limit":         optionValue(c.Metrics.CardinalityLimit),
+		"metrics.drop":                      c.Metrics.Drop,
+		"metrics.allow":                     c.Metrics.Allow,
+		"metrics.rename":                    pairValues(c.Metrics.Rename),
+		"metrics.emit-sum-counter":          optionValue(c.Metrics.EmitSumCounter),
+		"background.enabled":                optionValue(c.Background.Enabled),
+		"background.interval":               optionValue(c.Background.Interval),
+		"background.breaker-threshold":      optionValue(c.Background.BreakerThreshold),
+		"background.breaker-cooldown":       optionValue(c.Background.BreakerCooldown),
+		"log.level":                         optionValue(c.Log.Level),
+		"debug.config-endpoint":             optionValue(c.Debug.ConfigEndpoint),
+		"debug.pprof":                       optionValue(c.Debug.Pprof),
+		"shutdown.timeout":                  optionValue(c.Shutdown.Timeout),
+		"shutdown.drain-delay":              optionValue(c.Shutdown.DrainDelay),
+	}
+	if len(c.HTTP.DurationBuckets) > 0 {
+		buckets := make([]string, 0, len(c.HTTP.DurationBuckets))
+		for _, b := range c.HTTP.DurationBuckets {
+			buckets = append(buckets, strconv.FormatFloat(b, 'g', -1, 64))
+		}
+		values["http.duration-buckets"] = []string{strings.Join(buckets, ",")}
+	}
+	maps.DeleteFunc(values, func(_ string, vs []string) bool { return len(vs) == 0 })
+	return values
+}
+
+// optionValue returns the flag value of an option, or nothing if it isn't set.
+func optionValue[T any](v *T) []string {
+	if v == nil {
+		return nil
+	}
+	return []string{fmt.Sprint(*v)}
+}
+
+// pairValues returns the key=value flag values of a map option, sorted by key.
+func pairValues(m map[string]string) []string {
+	var vs []string
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		vs = append(vs, k+"="+m[k])
+	}
+	return vs
+}
+
+// setFlagsFromFile sets every flag that has not been set yet from the YAML
+// config file at path, whose schema is fileConfig. Unknown options and values
+// of the wrong type are errors.
+func setFlagsFromFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	var cfg fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	values := cfg.flagValues()
+	// Go through the options in order, so that errors are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if set[name] {
+			continue
+		}
+		for _, v := range values[name] {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value %q for option %s in config file %s: %w", v, name, path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// stringsFlag is a repeatable string flag that collects all values it is set to.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run runs the demo service until it is interrupted. Errors are returned
+// rather than causing an immediate exit, so that deferred cleanup such as the
+// final metrics flush still happens.
+func run() error {
+	startTime := time.Now()
+
+	listenAddr := flag.String("web.listen-addr", ":8080", "The address to listen on for web requests.")
+	var otelCfg otelConfig
+	flag.StringVar(&otelCfg.serviceName, "service.name", "otel-instrumentation-exercise", "The service name to report in the OpenTelemetry resource.")
+	flag.StringVar(&otelCfg.environment, "deployment.environment", "development", "The deployment environment to report as the deployment.environment resource attribute.")
+	flag.BoolVar(&otelCfg.environmentOnMetrics, "deployment.environment-on-metrics", false, "Also add the deployment.environment attribute to every metric.")
+	meterName := flag.String("meter.name", defaultMeterName, "The instrumentation scope name of the exported metrics.")
+	flag.StringVar(&otelCfg.exporter, "exporter", "otlp", "How to export metrics: \"otlp\" to push them or \"prometheus\" to expose them for scraping on /metrics.")
+	flag.StringVar(&otelCfg.protocol, "otlp.protocol", "http", "The OTLP protocol to use for pushing metrics (\"http\", \"grpc\", or \"stdout\" to print metrics instead).")
+	var otlpEndpoints stringsFlag
+	flag.Var(&otlpEndpoints, "otlp.endpoint", "The OTLP endpoint URL to push metrics to (repeatable, to push the same metrics to several backends). A unix:///path/to.sock URL sends them over a Unix domain socket. Defaults to "+defaultOTLPEndpoint+", or to "+defaultOTLPGRPCEndpoint+" for --otlp.protocol=grpc.")
+	flag.DurationVar(&otelCfg.fastExportInterval, "otlp.fast-interval", 0, "The interval at which the background_task.* metrics are exported via OTLP, separately from all other metrics. 0 exports them at --otlp.export-interval.")
+	waitForExport := flag.Bool("otlp.wait-for-export", false, "Report /healthz as not ready until the first OTLP metrics export has succeeded.")
+	flag.DurationVar(&otelCfg.exportInterval, "otlp.export-interval", 5*time.Second, "The interval at which metrics are exported via OTLP.")
+	var apiCfg demoAPIConfig
+	flag.StringVar(&apiCfg.downstreamURL, "demo.downstream-url", "", "A URL that the /api/foo handler requests before responding, e.g. http://localhost:8080/api/bar. Disabled if empty.")
+	flag.DurationVar(&apiCfg.extraLatency, "demo.extra-latency", 0, "A fixed duration that API handlers take on top of their usual random duration.")
+	flag.Float64Var(&apiCfg.errorRate, "demo.error-rate", 0, "The probability (0..1) with which API handlers fail with a 500 error.")
+	flag.DurationVar(&apiCfg.timeout, "http.timeout", 5*time.Second, "The maximum duration of API requests, after which they fail with a 503. 0 disables the timeout.")
+	flag.Int64Var(&apiCfg.maxBodyBytes, "http.max-body-bytes", 1<<20, "The maximum size of API request bodies in bytes. Larger requests are rejected with a 413. 0 disables the limit.")
+	flag.Float64Var(&apiCfg.rateLimit, "http.rate-limit", 0, "The maximum number of API requests per second, beyond which requests are rejected with a 429. 0 disables the limit.")
+	flag.BoolVar(&apiCfg.rateLimitPerRoute, "http.rate-limit-per-route", false, "Apply --http.rate-limit to each route separately instead of to all API requests together.")
+	flag.IntVar(&apiCfg.maxConcurrent, "http.max-concurrent", 0, "The maximum number of API requests that are handled at once. 0 disables the limit.")
+	flag.DurationVar(&apiCfg.maxConcurrentWait, "http.max-concurrent-wait", 0, "How long API requests beyond --http.max-concurrent wait for a free slot before they are rejected with a 503. 0 rejects them right away.")
+	flag.BoolVar(&apiCfg.accessLog, "http.access-log", false, "Log the method, route, status code, and duration of every API request.")
+	flag.BoolVar(&apiCfg.gzip, "http.gzip", false, "Gzip-compress API responses for clients that accept it, and record the compressed and uncompressed response sizes.")
+	flag.BoolVar(&apiCfg.recordClientSubnet, "http.record-client-subnet", false, "Add the client's /24 (IPv4) or /48 (IPv6) subnet as a client.subnet attribute to API request metrics.")
+	flag.BoolVar(&apiCfg.trustForwarded, "http.trust-forwarded", false, "Take the client address for --http.record-client-subnet from the last X-Forwarded-For entry. Only enable this behind a trusted proxy that appends the client address to that header.")
+	var attributeHeaders stringsFlag
+	flag.Var(&attributeHeaders, "http.attribute-header", "An attribute=Header pair, e.g. tenant=X-Tenant-Id, to add the request header's value as an attribute to API request metrics (repeatable).")
+	attributeHeaderPattern := flag.String("http.attribute-header-pattern", "[A-Za-z0-9_.-]{1,64}", "A regular expression that --http.attribute-header values must fully match. Other values are recorded as \"invalid\". Empty allows any value.")
+	flag.DurationVar(&apiCfg.sloThreshold, "http.slo-threshold", 250*time.Millisecond, "The latency below which API requests count towards http.server.requests.within_slo. 0 disables the counter.")
+	durationBucketsFlag := flag.String("http.duration-buckets", "", "Comma-separated, strictly increasing bucket boundaries (in seconds) for the HTTP request duration histogram. Defaults to 0.01,0.025,0.05,0.1,0.25,0.5,1 if empty.")
+	flag.BoolVar(&otelCfg.nativeHistogram, "http.native-histogram", false, "Export the HTTP request duration histogram as an exponential (native) histogram instead of using explicit buckets.")
+	flag.IntVar(&otelCfg.cardinalityLimit, "metrics.cardinality-limit", 500, "The maximum number of series of each histogram, like the HTTP request duration histogram, beyond which series are folded into an overflow series. 0 disables the limit. Not supported by the prometheus exporter.")
+	backgroundEnabled := flag.Bool("background.enabled", true, "Whether to run the background tasks and create their metrics.")
+	breakerThreshold := flag.Int("background.breaker-threshold", 0, "The number of consecutive background task failures after which runs are skipped for --background.breaker-cooldown. 0 disables the circuit breaker.")
+	breakerCooldown := flag.Duration("background.breaker-cooldown", 30*time.Second, "How long the background task's circuit breaker stays open before it tries again.")
+	backgroundJitter := flag.Float64("background.jitter", 0, "The fraction (0..1) of the background task interval by which each run is randomly moved earlier or later.")
+	backgroundInterval := flag.Duration("background.interval", 5*time.Second, "The interval at which the \"cleanup\" background task runs. The \"report\" task runs at twice this interval.")
+	flag.StringVar(&otelCfg.logsEndpoint, "otlp.logs-endpoint", "", "The OTLP/HTTP endpoint URL to push logs to, e.g. http://localhost:4318/v1/logs. Log export is disabled if empty.")
+	flag.StringVar(&otelCfg.tracesEndpoint, "otlp.traces-endpoint", "", "The OTLP/HTTP endpoint URL to push traces to, e.g. http://localhost:4318/v1/traces. Tracing is disabled if empty.")
+	otlpCAFile := flag.String("otlp.ca-file", "", "A PEM file with CA certificates to verify the OTLP endpoint's TLS certificate.")
+	flag.BoolVar(&otelCfg.insecure, "otlp.insecure", false, "Disable TLS for OTLP export connections.")
+	flag.DurationVar(&otelCfg.retryMaxElapsed, "otlp.retry-max-elapsed", time.Minute, "The maximum time to keep retrying a failed OTLP export with exponential backoff. 0 disables retries.")
+	flag.StringVar(&otelCfg.compression, "otlp.compression", "gzip", "The compression to use for OTLP export payloads (\"none\" or \"gzip\").")
+	flag.StringVar(&otelCfg.temporality, "otlp.temporality", "cumulative", "The aggregation temporality of exported counters and histograms (\"cumulative\" or \"delta\"). Prometheus expects cumulative.")
+	var dropMetrics stringsFlag
+	flag.Var(&dropMetrics, "metrics.drop", "The exact name of an instrument whose metrics should not be exported (repeatable).")
+	flag.BoolVar(&otelCfg.emitSumCounter, "metrics.emit-sum-counter", false, "Additionally export the sum of the HTTP request duration histogram as an http.server.request.duration.sum counter.")
+	var allowMetrics stringsFlag
+	flag.Var(&allowMetrics, "metrics.allow", "The exact name of an instrument whose metrics should be exported (repeatable). If set, all other instruments are dropped. Takes precedence over --metrics.drop.")
+	var renameMetrics stringsFlag
+	flag.Var(&renameMetrics, "metrics.rename", "An old=new pair of instrument names to export the old instrument's metrics under the new name (repeatable). --metrics.allow and --metrics.drop accept either name.")
+	var otlpHeaders stringsFlag
+	flag.Var(&otlpHeaders, "otlp.header", "A key=value header to send with OTLP export requests (repeatable).")
+	logLevel := flag.String("log.level", "info", "The minimum level of log messages to output (\"debug\", \"info\", \"warn\", or \"error\").")
+	enableConfigEndpoint := flag.Bool("debug.config-endpoint", false, "Serve the effective flag values as JSON under /config, with likely secrets redacted.")
+	enablePprof := flag.Bool("debug.pprof", false, "Serve pprof profiling endpoints under /debug/pprof/.")
+	configFile := flag.String("config", "", "A YAML file with values for any of the other flags, nested by the parts of their names, e.g. otlp: {export-interval: 15s}. Unknown options are errors. Flags and environment variables take precedence.")
+	flag.BoolVar(&otelCfg.dryRun, "dry-run", false, "Print the collected metrics to stdout at every --otlp.export-interval instead of exporting them, e.g. to check the instrumentation without a backend.")
+	shutdownTimeout := flag.Duration("shutdown.timeout", 10*time.Second, "The maximum time for draining in-flight requests and flushing telemetry on shutdown, shared by all steps.")
+	drainDelay := flag.Duration("shutdown.drain-delay", 0, "How long to keep serving requests while /healthz reports 503 on shutdown, so that load balancers stop sending traffic before the listener closes. Not part of --shutdown.timeout.")
+	printVersion := flag.Bool("version", false, "Print version information and exit.")
+	flag.Parse()
+	if *printVersion {
+		fmt.Printf("version: %s\nrevision: %s\nbuild date: %s\ngo version: %s\n", version, revision, buildDate, runtime.Version())
+		return nil
+	}
+	// Command line flags take precedence over environment variables, which
+	// take precedence over the config file.
+	if err := setFlagsFromEnv(flag.CommandLine, "OTEL_EX_"); err != nil {
+		log.Fatal(err)
+	}
+	if *configFile != "" {
+		if err := setFlagsFromFile(flag.CommandLine, *configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatalf("Invalid --log.level %q: %v", *logLevel, err)
+	}
+	logHandler := slog.Handler(traceContextHandler{
+		Handler: slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}),
+	})
+	slog.SetDefault(slog.New(logHandler))
+	// Remaining uses of the log package are fatal errors, so log them as such.
+	slog.SetLogLoggerLevel(slog.LevelError)
+
+	if otelCfg.exporter != "otlp" && otelCfg.exporter != "prometheus" {
+		log.Fatalf("Invalid --exporter %q: must be \"otlp\" or \"prometheus\"", otelCfg.exporter)
+	}
+	switch otelCfg.protocol {
+	case "http", "grpc", "stdout":
+	default:
+		log.Fatalf("Invalid --otlp.protocol %q: must be \"http\", \"grpc\", or \"stdout\"", otelCfg.protocol)
+	}
+	otelCfg.endpoints = otlpEndpoints
+	if len(otelCfg.endpoints) == 0 {
+		otelCfg.endpoints = []string{defaultOTLPEndpoint}
+		if otelCfg.protocol == "grpc" {
+			otelCfg.endpoints = []string{defaultOTLPGRPCEndpoint}
+		}
+	}
+	for _, endpoint := range otelCfg.endpoints {
+		if _, ok := unixSocketPath(endpoint); ok {
+			continue
+		}
+		if u, err := url.Parse(endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("Invalid --otlp.endpoint URL %q: must be an absolute URL like http://host:port/path or unix:///path/to.sock", endpoint)
+		}
+	}
+	if otelCfg.logsEndpoint != "" {
+		if u, err := url.Parse(otelCfg.logsEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("Invalid --otlp.logs-endpoint URL %q: must be an absolute URL like http://host:port/path", otelCfg.logsEndpoint)
+		}
+	}
+	if otelCfg.tracesEndpoint != "" {
+		if u, err := url.Parse(otelCfg.tracesEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("Invalid --otlp.traces-endpoint URL %q: must be an absolute URL like http://host:port/path", otelCfg.tracesEndpoint)
+		}
+	}
+	if otelCfg.exportInterval <= 0 {
+		log.Fatalf("Invalid --otlp.export-interval %v: must be positive", otelCfg.exportInterval)
+	}
+	if otelCfg.fastExportInterval < 0 {
+		log.Fatalf("Invalid --otlp.fast-interval %v: must not be negative", otelCfg.fastExportInterval)
+	}
+	if otelCfg.compression != "none" && otelCfg.compression != "gzip" {
+		log.Fatalf("Invalid --otlp.compression %q: must be \"none\" or \"gzip\"", otelCfg.compression)
+	}
+	if otelCfg.temporality != "cumulative" && otelCfg.temporality != "delta" {
+		log.Fatalf("Invalid --otlp.temporality %q: must be \"cumulative\" or \"delta\"", otelCfg.temporality)
+	}
+	if otelCfg.cardinalityLimit < 0 {
+		log.Fatalf("Invalid --metrics.cardinality-limit %d: must not be negative", otelCfg.cardinalityLimit)
+	}
+	if otelCfg.retryMaxElapsed < 0 {
+		log.Fatalf("Invalid --otlp.retry-max-elapsed %v: must not be negative", otelCfg.retryMaxElapsed)
+	}
+	durationBuckets, err := parseBuckets(*durationBucketsFlag)
+	if err != nil {
+		log.Fatalf("Invalid --http.duration-buckets: %v", err)
+	}
+	if len(durationBuckets) == 0 {
+		durationBuckets = middleware.DefaultDurationBuckets
+	}
+	apiCfg.durationBuckets = durationBuckets
+	apiCfg.nativeHistogram = otelCfg.nativeHistogram
+	if apiCfg.errorRate < 0 || apiCfg.errorRate > 1 {
+		log.Fatalf("Invalid --demo.error-rate %v: must be between 0 and 1", apiCfg.errorRate)
+	}
+	if apiCfg.timeout < 0 {
+		log.Fatalf("Invalid --http.timeout %v: must not be negative", apiCfg.timeout)
+	}
+	if apiCfg.maxBodyBytes < 0 {
+		log.Fatalf("Invalid --http.max-body-bytes %d: must not be negative", apiCfg.maxBodyBytes)
+	}
+	if *shutdownTimeout <= 0 {
+		log.Fatalf("Invalid --shutdown.timeout %v: must be positive", *shutdownTimeout)
+	}
+	if *drainDelay < 0 {
+		log.Fatalf("Invalid --shutdown.drain-delay %v: must not be negative", *drainDelay)
+	}
+	if apiCfg.extraLatency < 0 {
+		log.Fatalf("Invalid --demo.extra-latency %v: must not be negative", apiCfg.extraLatency)
+	}
+	if apiCfg.maxConcurrent < 0 {
+		log.Fatalf("Invalid --http.max-concurrent %d: must not be negative", apiCfg.maxConcurrent)
+	}
+	if apiCfg.maxConcurrentWait < 0 {
+		log.Fatalf("Invalid --http.max-concurrent-wait %v: must not be negative", apiCfg.maxConcurrentWait)
+	}
+	if apiCfg.rateLimit < 0 {
+		log.Fatalf("Invalid --http.rate-limit %v: must not be negative", apiCfg.rateLimit)
+	}
+	if apiCfg.sloThreshold < 0 {
+		log.Fatalf("Invalid --http.slo-threshold %v: must not be negative", apiCfg.sloThreshold)
+	}
+	if *meterName == "" {
+		log.Fatal("Invalid --meter.name: must not be empty")
+	}
+	if *backgroundInterval <= 0 {
+		log.Fatalf("Invalid --background.interval %v: must be positive", *backgroundInterval)
+	}
+	if *backgroundJitter < 0 || *backgroundJitter >= 1 {
+		log.Fatalf("Invalid --background.jitter %v: must be at least 0 and less than 1", *backgroundJitter)
+	}
+	if *breakerThreshold < 0 {
+		log.Fatalf("Invalid --background.breaker-threshold %d: must not be negative", *breakerThreshold)
+	}
+	if *breakerCooldown <= 0 {
+		log.Fatalf("Invalid --background.breaker-cooldown %v: must be positive", *breakerCooldown)
+	}
+	if *otlpCAFile != "" {
+		tlsConfig, err := newTLSConfig(*otlpCAFile)
+		if err != nil {
+			log.Fatalf("Invalid --otlp.ca-file: %v", err)
+		}
+		otelCfg.tlsConfig = tlsConfig
+	}
+	otelCfg.headers = make(map[string]string, len(otlpHeaders))
+	for _, h := range otlpHeaders {
+		k, v, ok := strings.Cut(h, "=")
+		if !ok || k == "" {
+			log.Fatalf("Invalid --otlp.header %q: must be in key=value format", h)
+		}
+		otelCfg.headers[k] = v
+	}
+	apiCfg.attributeHeaders = make(map[string]string, len(attributeHeaders))
+	for _, h := range attributeHeaders {
+		name, header, ok := strings.Cut(h, "=")
+		if !ok || name == "" || header == "" {
+			log.Fatalf("Invalid --http.attribute-header %q: must be in attribute=Header format", h)
+		}
+		apiCfg.attributeHeaders[name] = header
+	}
+	if *attributeHeaderPattern != "" {
+		re, err := regexp.Compile("^(?:" + *attributeHeaderPattern + ")$")
+		if err != nil {
+			log.Fatalf("Invalid --http.attribute-header-pattern %q: %v", *attributeHeaderPattern, err)
+		}
+		apiCfg.attributeHeaderPattern = re
+	}
+	otelCfg.dropMetrics = dropMetrics
+	otelCfg.allowMetrics = allowMetrics
+	otelCfg.renameMetrics = make(map[string]string, len(renameMetrics))
+	for _, r := range renameMetrics {
+		oldName, newName, ok := strings.Cut(r, "=")
+		if !ok || oldName == "" {
+			log.Fatalf("Invalid --metrics.rename %q: must be in old=new format", r)
+		}
+		if !instrumentNameRE.MatchString(newName) {
+			log.Fatalf("Invalid --metrics.rename %q: %q is not a valid instrument name", r, newName)
+		}
+		otelCfg.renameMetrics[oldName] = newName
+	}
+
+	// Use a dedicated registry rather than the default one, whose Go and process
+	// collectors would clash with the OpenTelemetry runtime and process metrics.
+	otelCfg.promRegistry = prometheus.NewRegistry()
+
+	// Container runtimes like Kubernetes stop containers with SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// All shutdown steps share a single time budget, which starts once the
+	// server stops serving, so that e.g. a wedged collector can't block the exit.
+	// Deferred steps start it themselves in case run() returns early.
+	var (
+		shutdownCtx    context.Context
+		cancelShutdown context.CancelFunc
+	)
+	defer func() {
+		if cancelShutdown != nil {
+			cancelShutdown()
+		}
+	}()
+	startShutdown := func() {
+		if cancelShutdown == nil {
+			shutdownCtx, cancelShutdown = context.WithTimeout(context.Background(), *shutdownTimeout)
+		}
+	}
+
+	if otelCfg.logsEndpoint != "" {
+		// Set up logs first, so that they are shut down last and still receive
+		// the logs from the other shutdown steps.
+		shutdownLogs, err := setupLogs(ctx, otelCfg)
+		if err != nil {
+			return fmt.Errorf("setting up OpenTelemetry logs: %w", err)
+		}
+		defer func() {
+			startShutdown()
+			if err := shutdownLogs(shutdownCtx); err != nil {
+				logShutdownError("shutting down logs", err)
+			}
+		}()
+
+		// Keep logging to stderr, but also send logs via OTLP.
+		slog.SetDefault(slog.New(slog.NewMultiHandler(
+			logHandler,
+			levelHandler{
+				Handler: otelslog.NewHandler("otel-instrumentation-exercise"),
+				level:   level,
+			},
+		)))
+	}
+
+	// Honor W3C traceparent headers of incoming requests, so that our spans and
+	// exemplars link to upstream traces.
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	// Scraped metrics are never exported by us, so there's nothing to wait for.
+	if *waitForExport && otelCfg.exporter == "otlp" && !otelCfg.dryRun {
+		otelCfg.exported = &atomic.Bool{}
+	}
+	meterProvider, err := setupOtel(ctx, otelCfg)
+	if err != nil && otelCfg.exporter == "otlp" && otelCfg.protocol != "stdout" {
+		// Keep the service running with its metrics visible in the output, rather
+		// than failing over a misconfigured endpoint.
+		slog.Error("Error setting up OTLP metrics export, falling back to the stdout exporter.", "err", err)
+		otelCfg.protocol = "stdout"
+		meterProvider, err = setupOtel(ctx, otelCfg)
+	}
+	if err != nil {
+		return fmt.Errorf("setting up OpenTelemetry metrics: %w", err)
+	}
+	defer func() {
+		startShutdown()
+		// Collect and export once more, since the last periodic export may have
+		// been a while ago.
+		if err := meterProvider.ForceFlush(shutdownCtx); err != nil {
+			logShutdownError("flushing metrics", err)
+		} else {
+			slog.Info("Flushed metrics.")
+		}
+		if err := meterProvider.Shutdown(shutdownCtx); err != nil {
+			logShutdownError("shutting down metrics", err)
+		}
+	}()
+
+	if otelCfg.tracesEndpoint != "" {
+		shutdownTracing, err := setupTracing(ctx, otelCfg)
+		if err != nil {
+			return fmt.Errorf("setting up OpenTelemetry tracing: %w", err)
+		}
+		defer func() {
+			startShutdown()
+			if err := shutdownTracing(shutdownCtx); err != nil {
+				logShutdownError("shutting down tracing", err)
+			}
+		}()
+	}
+
+	m, err := newMetrics(otel.Meter(*meterName, metric.WithInstrumentationVersion(instrumentationVersion())), apiCfg, *backgroundEnabled, startTime)
+	if err != nil {
+		return fmt.Errorf("creating metrics: %w", err)
+	}
+	m.logRegisteredMetrics()
+	if n := m.validateInstruments(); n > 0 {
+		slog.Warn("Found instruments that may not be exported as expected.", "problems", n)
+	}
+	slog.Info("Cumulative counters start at zero on every process start; use rate() or increase() to compare across restarts.")
+
+	if *backgroundEnabled {
+		cleanupCfg := backgroundTaskConfig{
+			interval:         *backgroundInterval,
+			jitter:           *backgroundJitter,
+			breakerThreshold: *breakerThreshold,
+			breakerCooldown:  *breakerCooldown,
+		}
+		reportCfg := cleanupCfg
+		reportCfg.interval = 2 * *backgroundInterval
+
+		var runner taskRunner
+		runner.register("cleanup", func(ctx context.Context) {
+			periodicBackgroundTask(ctx, m.background, "cleanup", cleanupCfg, simulateBackgroundWork)
+		})
+		runner.register("report", func(ctx context.Context) {
+			periodicBackgroundTask(ctx, m.background, "report", reportCfg, simulateBackgroundWork)
+		})
+		go runner.run(ctx)
+	}
+
+	api := newDemoAPI(m, apiCfg)
+	slog.Info("Configured HTTP request duration histogram.", "buckets", apiCfg.durationBuckets, "native_histogram", otelCfg.nativeHistogram)
+
+	// Use our own mux, since importing net/http/pprof registers its handlers
+	// on the default one.
+	mux := http.NewServeMux()
+	api.register(mux)
+
+	// The health check is deliberately not instrumented, so that probes don't
+	// show up in the API's request metrics.
+	mux.HandleFunc("/healthz", healthz(m.shuttingDown, otelCfg.exported))
+	if otelCfg.exporter == "prometheus" {
+		mux.Handle("/metrics", promhttp.HandlerFor(otelCfg.promRegistry, promhttp.HandlerOpts{}))
+	}
+	if *enableConfigEndpoint {
+		// The config endpoint is only meant for debugging, so it isn't instrumented.
+		mux.HandleFunc("/config", configHandler(flag.CommandLine))
+	}
+	if *enablePprof {
+		// Profiling requests are not instrumented either.
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	// Track when requests arrive on their connections, so that the time they
+	// wait before being handled can be recorded.
+	var connTracker middleware.ConnTracker
+	server := &http.Server{
+		Addr:        *listenAddr,
+		Handler:     mux,
+		ConnContext: connTracker.ConnContext,
+		ConnState:   connTracker.ConnState,
+	}
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", server.Addr, err)
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		if err := server.Serve(connTracker.Listener(ln)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+
+	select {
+	case err := <-serverErr:
+		startShutdown()
+		return fmt.Errorf("error running HTTP server: %w", err)
+	case <-ctx.Done():
+	}
+	m.shuttingDown.Store(true)
+	if *drainDelay > 0 {
+		// Keep serving while load balancers notice the failing /healthz.
+		slog.Info("Draining traffic before shutting down...", "delay", *drainDelay)
+		time.Sleep(*drainDelay)
+	}
+	startShutdown()
+
+	// Let in-flight requests finish before the deferred OpenTelemetry shutdown
+	// exports the final metrics.
+	slog.Info("Shutting down HTTP server...", "timeout", *shutdownTimeout)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logShutdownError("shutting down HTTP server", err)
+	}
+	return nil
+}
+
+// logShutdownError logs an error of the given shutdown step, pointing out
+// when the step ran out of the --shutdown.timeout budget.
+func logShutdownError(step string, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Error("Shutdown timed out.", "step", step, "err", err)
+		return
+	}
+	slog.Error("Error during shutdown.", "step", step, "err", err)
 }
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdk_metric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdk_trace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestNewDemoAPIWithMeterProvider(t *testing.T) {
+	reader := sdk_metric.NewManualReader()
+	mp := sdk_metric.NewMeterProvider(sdk_metric.WithReader(reader))
+
+	api, err := newDemoAPIWithMeterProvider(mp, demoAPIConfig{})
+	if err != nil {
+		t.Fatalf("Error creating demo API: %v", err)
+	}
+	mux := http.NewServeMux()
+	api.register(mux)
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/foo", nil))
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("Error collecting metrics: %v", err)
+	}
+	if got := sumInt64(rm, "http.server.requests.total"); got != 1 {
+		t.Errorf("Expected 1 request to be recorded through the given MeterProvider, got %d.", got)
+	}
+}
+
+func TestRequestDurationHistogram(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantRoute  string
+	}{
+		{
+			name:       "known route",
+			path:       "/api/foo",
+			wantStatus: http.StatusOK,
+			wantRoute:  "/api/foo",
+		},
+		{
+			name:       "unknown route",
+			path:       "/api/unknown",
+			wantStatus: http.StatusNotFound,
+			wantRoute:  "<not_found>",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := sdk_metric.NewManualReader()
+			mp := sdk_metric.NewMeterProvider(sdk_metric.WithReader(reader))
+
+			api, err := newDemoAPIWithMeterProvider(mp, demoAPIConfig{})
+			if err != nil {
+				t.Fatalf("Error creating demo API: %v", err)
+			}
+			mux := http.NewServeMux()
+			api.register(mux)
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL + tc.path)
+			if err != nil {
+				t.Fatalf("Error sending request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("Expected status %d, got %d.", tc.wantStatus, resp.StatusCode)
+			}
+
+			var rm metricdata.ResourceMetrics
+			if err := reader.Collect(context.Background(), &rm); err != nil {
+				t.Fatalf("Error collecting metrics: %v", err)
+			}
+			hist, ok := findFloat64Histogram(rm, "http.server.request.duration")
+			if !ok || len(hist.DataPoints) != 1 {
+				t.Fatalf("Expected one request duration data point, got %+v.", hist.DataPoints)
+			}
+			dp := hist.DataPoints[0]
+			if dp.Count != 1 {
+				t.Errorf("Expected one observation, got %d.", dp.Count)
+			}
+			if dp.Sum <= 0 {
+				t.Errorf("Expected a positive duration sum, got %v.", dp.Sum)
+			}
+			if route, ok := dp.Attributes.Value("http.route"); !ok || route.AsString() != tc.wantRoute {
+				t.Errorf("Expected http.route attribute %q, got %q.", tc.wantRoute, route.Emit())
+			}
+			if code, ok := dp.Attributes.Value("http.response.status_code"); !ok || code.AsInt64() != int64(tc.wantStatus) {
+				t.Errorf("Expected http.response.status_code attribute %d, got %q.", tc.wantStatus, code.Emit())
+			}
+		})
+	}
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID = "00f067aa0ba902b7"
+	)
+
+	recorder := tracetest.NewSpanRecorder()
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdk_trace.NewTracerProvider(sdk_trace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+
+	mp := sdk_metric.NewMeterProvider(sdk_metric.WithReader(sdk_metric.NewManualReader()))
+	api, err := newDemoAPIWithMeterProvider(mp, demoAPIConfig{})
+	if err != nil {
+		t.Fatalf("Error creating demo API: %v", err)
+	}
+	mux := http.NewServeMux()
+	api.register(mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/foo", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected one ended span, got %d.", len(spans))
+	}
+	span := spans[0]
+	if got := span.SpanContext().TraceID().String(); got != traceID {
+		t.Errorf("Expected trace ID %s, got %s.", traceID, got)
+	}
+	if got := span.Parent().SpanID().String(); got != parentSpanID {
+		t.Errorf("Expected parent span ID %s, got %s.", parentSpanID, got)
+	}
+	if !span.Parent().IsRemote() {
+		t.Error("Expected the parent span context to be remote.")
+	}
+}
+
+func TestBackgroundTaskRecordRunFailure(t *testing.T) {
+	reader := sdk_metric.NewManualReader()
+	mp := sdk_metric.NewMeterProvider(sdk_metric.WithReader(reader))
+	m, err := newBackgroundTaskMetrics(mp.Meter("test"), time.Now())
+	if err != nil {
+		t.Fatalf("Error creating background task metrics: %v", err)
+	}
+
+	m.recordRun("test", time.Now(), errors.New("boom"))
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("Error collecting metrics: %v", err)
+	}
+	for name, want := range map[string]int64{
+		"background_task.runs":      1,
+		"background_task.failures":  1,
+		"background_task.successes": 0,
+	} {
+		if got := sumInt64(rm, name); got != want {
+			t.Errorf("Expected %s to be %d, got %d.", name, want, got)
+		}
+	}
+	if _, ok := findMetric(rm, "background_task.last_success.timestamp"); ok {
+		t.Error("Expected no background_task.last_success.timestamp after a failed run.")
+	}
+	if _, ok := findMetric(rm, "background_task.last_run.timestamp"); !ok {
+		t.Error("Expected background_task.last_run.timestamp to be recorded.")
+	}
+}
+
+// findMetric returns the metric with the given name from the collected
+// metrics.
+func findMetric(rm metricdata.ResourceMetrics, name string) (metricdata.Metrics, bool) {
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				return m, true
+			}
+		}
+	}
+	return metricdata.Metrics{}, false
+}
+
+// sumInt64 returns the total of all data points of an Int64 sum, or 0 if the
+// metric wasn't recorded.
+func sumInt64(rm metricdata.ResourceMetrics, name string) int64 {
+	m, ok := findMetric(rm, name)
+	if !ok {
+		return 0
+	}
+	sum, _ := m.Data.(metricdata.Sum[int64])
+	var total int64
+	for _, dp := range sum.DataPoints {
+		total += dp.Value
+	}
+	return total
+}
+
+// findFloat64Histogram returns the data of the float64 histogram with the
+// given name from the collected metrics.
+func findFloat64Histogram(rm metricdata.ResourceMetrics, name string) (metricdata.Histogram[float64], bool) {
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+			h, ok := m.Data.(metricdata.Histogram[float64])
+			return h, ok
+		}
+	}
+	return metricdata.Histogram[float64]{}, false
+}
+
+func TestMetricViews(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  otelConfig
+		// want maps the exported metric names to their kinds of data.
+		want map[string]string
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{"http.server.request.duration": "histogram", "http.server.requests.total": "sum"},
+		},
+		{
+			name: "native histogram",
+			cfg:  otelConfig{nativeHistogram: true},
+			want: map[string]string{"http.server.request.duration": "exponential histogram", "http.server.requests.total": "sum"},
+		},
+		{
+			name: "drop",
+			cfg:  otelConfig{dropMetrics: []string{"http.server.requests.total"}},
+			want: map[string]string{"http.server.request.duration": "histogram"},
+		},
+		{
+			name: "allow",
+			cfg:  otelConfig{allowMetrics: []string{"http.server.requests.total"}},
+			want: map[string]string{"http.server.requests.total": "sum"},
+		},
+		{
+			name: "allow takes precedence over drop",
+			cfg: otelConfig{
+				allowMetrics: []string{"http.server.requests.total"},
+				dropMetrics:  []string{"http.server.requests.total"},
+			},
+			want: map[string]string{"http.server.requests.total": "sum"},
+		},
+		{
+			name: "rename",
+			cfg:  otelConfig{renameMetrics: map[string]string{"http.server.request.duration": "foo"}},
+			want: map[string]string{"foo": "histogram", "http.server.requests.total": "sum"},
+		},
+		{
+			name: "rename and allow the new name",
+			cfg: otelConfig{
+				renameMetrics: map[string]string{"http.server.request.duration": "foo"},
+				allowMetrics:  []string{"foo"},
+			},
+			want: map[string]string{"foo": "histogram"},
+		},
+		{
+			name: "rename and drop the new name",
+			cfg: otelConfig{
+				renameMetrics: map[string]string{"http.server.request.duration": "foo"},
+				dropMetrics:   []string{"foo"},
+			},
+			want: map[string]string{"http.server.requests.total": "sum"},
+		},
+		{
+			name: "rename native histogram",
+			cfg: otelConfig{
+				nativeHistogram: true,
+				renameMetrics:   map[string]string{"http.server.request.duration": "foo"},
+			},
+			want: map[string]string{"foo": "exponential histogram", "http.server.requests.total": "sum"},
+		},
+		{
+			name: "emit sum",
+			cfg:  otelConfig{emitSumCounter: true},
+			want: map[string]string{
+				"http.server.request.duration":     "histogram",
+				"http.server.request.duration.sum": "sum",
+				"http.server.requests.total":       "sum",
+			},
+		},
+		{
+			name: "emit sum with native histogram",
+			cfg:  otelConfig{emitSumCounter: true, nativeHistogram: true},
+			want: map[string]string{
+				"http.server.request.duration":     "exponential histogram",
+				"http.server.request.duration.sum": "sum",
+				"http.server.requests.total":       "sum",
+			},
+		},
+		{
+			name: "emit sum and drop the histogram",
+			cfg:  otelConfig{emitSumCounter: true, dropMetrics: []string{"http.server.request.duration"}},
+			want: map[string]string{"http.server.requests.total": "sum"},
+		},
+		{
+			name: "emit sum and drop the sum",
+			cfg:  otelConfig{emitSumCounter: true, dropMetrics: []string{"http.server.request.duration.sum"}},
+			want: map[string]string{"http.server.request.duration": "histogram", "http.server.requests.total": "sum"},
+		},
+		{
+			name: "emit sum and allow the histogram",
+			cfg:  otelConfig{emitSumCounter: true, allowMetrics: []string{"http.server.request.duration"}},
+			want: map[string]string{"http.server.request.duration": "histogram", "http.server.request.duration.sum": "sum"},
+		},
+		{
+			name: "emit sum and allow only the sum",
+			cfg:  otelConfig{emitSumCounter: true, allowMetrics: []string{"http.server.request.duration.sum"}},
+			want: map[string]string{"http.server.request.duration.sum": "sum"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := sdk_metric.NewManualReader()
+			mp := sdk_metric.NewMeterProvider(sdk_metric.WithReader(reader), sdk_metric.WithView(metricViews(tc.cfg)...))
+			meter := mp.Meter("test")
+
+			durations, err := meter.Float64Histogram("http.server.request.duration")
+			if err != nil {
+				t.Fatalf("Error creating histogram: %v", err)
+			}
+			requests, err := meter.Int64Counter("http.server.requests.total")
+			if err != nil {
+				t.Fatalf("Error creating counter: %v", err)
+			}
+			durations.Record(context.Background(), 0.1)
+			requests.Add(context.Background(), 1)
+
+			var rm metricdata.ResourceMetrics
+			if err := reader.Collect(context.Background(), &rm); err != nil {
+				t.Fatalf("Error collecting metrics: %v", err)
+			}
+			got := map[string]string{}
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					switch m.Data.(type) {
+					case metricdata.Histogram[float64]:
+						got[m.Name] = "histogram"
+					case metricdata.ExponentialHistogram[float64]:
+						got[m.Name] = "exponential histogram"
+					case metricdata.Sum[float64], metricdata.Sum[int64]:
+						got[m.Name] = "sum"
+					default:
+						got[m.Name] = fmt.Sprintf("%T", m.Data)
+					}
+				}
+			}
+			if !maps.Equal(got, tc.want) {
+				t.Errorf("Expected exported metrics %v, got %v.", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSetFlagsFromFile(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  string
+		args    []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "all kinds of options",
+			config: `
+otlp:
+  endpoint: [http://a:4318/v1/metrics, http://b:4318/v1/metrics]
+  export-interval: 15s
+http:
+  duration-buckets: [0.1, 0.5, 1]
+metrics:
+  rename: {b: y, a: x}
+`,
+			want: map[string]string{
+				"otlp.endpoint":         "http://a:4318/v1/metrics,http://b:4318/v1/metrics",
+				"otlp.export-interval":  "15s",
+				"http.duration-buckets": "0.1,0.5,1",
+				"metrics.rename":        "a=x,b=y",
+			},
+		},
+		{
+			name:   "flags take precedence",
+			config: "otlp: {export-interval: 15s}",
+			args:   []string{"--otlp.export-interval=30s"},
+			want:   map[string]string{"otlp.export-interval": "30s"},
+		},
+		{
+			name: "empty file",
+			want: map[string]string{"otlp.export-interval": "5s"},
+		},
+		{
+			name:    "unknown option",
+			config:  "otlp: {export-intervall: 15s}",
+			wantErr: true,
+		},
+		{
+			name:    "wrong type",
+			config:  "otlp: {export-interval: [15s]}",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			var endpoints, renames stringsFlag
+			fs.Var(&endpoints, "otlp.endpoint", "")
+			fs.Duration("otlp.export-interval", 5*time.Second, "")
+			fs.String("http.duration-buckets", "", "")
+			fs.Var(&renames, "metrics.rename", "")
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatalf("Error parsing flags: %v", err)
+			}
+
+			path := filepath.Join(t.TempDir(), "config.yml")
+			if err := os.WriteFile(path, []byte(tc.config), 0o644); err != nil {
+				t.Fatalf("Error writing config file: %v", err)
+			}
+			err := setFlagsFromFile(fs, path)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected an error, got none.")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error setting flags from file: %v", err)
+			}
+			for name, want := range tc.want {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("Expected --%s=%s, got %s.", name, want, got)
+				}
+			}
+		})
+	}
+}
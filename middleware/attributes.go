@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// maxCachedAttributeSets limits the size of each attribute cache, since some
+// attribute values, like the request method, are chosen by the client.
+const maxCachedAttributeSets = 1000
+
+// attributeCaches holds the attribute sets that requests are recorded with, so
+// that they don't need to be allocated again for every request.
+type attributeCaches struct {
+	routeOnly attributeCache[string]
+	route     attributeCache[routeKey]
+	duration  attributeCache[durationKey]
+	count     attributeCache[countKey]
+}
+
+type routeKey struct {
+	route, method string
+}
+
+type durationKey struct {
+	routeKey
+	status      int
+	cancelled   bool
+	outcome     string
+	contentType string
+}
+
+type countKey struct {
+	routeKey
+	statusClass int
+}
+
+// attributeCache maps keys to measurement options with the attribute set that
+// the key stands for.
+type attributeCache[K comparable] struct {
+	mu   sync.RWMutex
+	opts map[K]metric.MeasurementOption
+}
+
+// get returns the measurement option for key, creating it from the
+// attributes returned by attrs if it isn't cached yet.
+func (c *attributeCache[K]) get(key K, attrs func() []attribute.KeyValue) metric.MeasurementOption {
+	c.mu.RLock()
+	opt, ok := c.opts[key]
+	c.mu.RUnlock()
+	if ok {
+		return opt
+	}
+
+	opt = metric.WithAttributeSet(attribute.NewSet(attrs()...))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opts == nil {
+		c.opts = map[K]metric.MeasurementOption{}
+	}
+	if len(c.opts) < maxCachedAttributeSets {
+		c.opts[key] = opt
+	}
+	return opt
+}
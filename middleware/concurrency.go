@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"context"
+	"time"
+)
+
+// concurrencyLimiter limits the number of requests that are handled at once.
+type concurrencyLimiter struct {
+	slots chan struct{}
+	// maxWait is how long a request waits for a free slot before it is
+	// rejected. Zero rejects requests right away if all slots are taken.
+	maxWait time.Duration
+}
+
+func newConcurrencyLimiter(n int, maxWait time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{slots: make(chan struct{}, n), maxWait: maxWait}
+}
+
+// acquire takes a slot, waiting up to maxWait for one to become free. It
+// reports whether it got one, in which case release must be called once the
+// request has been handled.
+func (l *concurrencyLimiter) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.maxWait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ConnTracker records when the first byte of each request arrives on a
+// connection, so that the middleware can tell how long a request took to
+// arrive and be parsed (including the TLS handshake of a new connection)
+// before its handler ran. Serve on a listener wrapped with Listener, and set
+// its ConnContext and ConnState methods as the server's hooks of the same
+// name.
+//
+// Pipelined requests that net/http already buffered together with an earlier
+// request aren't tracked.
+type ConnTracker struct{}
+
+type requestStartKey struct{}
+
+// trackedConn records the time of the first read of each request.
+type trackedConn struct {
+	net.Conn
+	// start is the time at which the first byte of the current request was
+	// read, or zero while waiting for it.
+	start atomic.Int64
+	// waiting is set while the connection waits for the next request.
+	waiting atomic.Bool
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.waiting.CompareAndSwap(true, false) {
+		c.start.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// NetConn returns the underlying connection.
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+type trackingListener struct {
+	net.Listener
+}
+
+func (l trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{Conn: c}
+	tc.waiting.Store(true)
+	return tc, nil
+}
+
+// Listener wraps l so that its connections record when requests arrive.
+func (t *ConnTracker) Listener(l net.Listener) net.Listener {
+	return trackingListener{Listener: l}
+}
+
+// ConnContext adds the connection's request start time to its context.
+func (t *ConnTracker) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := asTrackedConn(c); ok {
+		return context.WithValue(ctx, requestStartKey{}, &tc.start)
+	}
+	return ctx
+}
+
+// ConnState waits for the first byte of the next request whenever a
+// connection becomes idle.
+func (t *ConnTracker) ConnState(c net.Conn, state http.ConnState) {
+	if state != http.StateIdle {
+		return
+	}
+	if tc, ok := asTrackedConn(c); ok {
+		tc.start.Store(0)
+		tc.waiting.Store(true)
+	}
+}
+
+// asTrackedConn returns the trackedConn of c, which may be wrapped by a
+// *tls.Conn.
+func asTrackedConn(c net.Conn) (*trackedConn, bool) {
+	if tc, ok := c.(*trackedConn); ok {
+		return tc, true
+	}
+	if nc, ok := c.(interface{ NetConn() net.Conn }); ok {
+		tc, ok := nc.NetConn().(*trackedConn)
+		return tc, ok
+	}
+	return nil, false
+}
+
+// requestStart returns the time at which the first byte of the request was
+// read, if the server tracks it with a ConnTracker.
+func requestStart(ctx context.Context) (time.Time, bool) {
+	start, ok := ctx.Value(requestStartKey{}).(*atomic.Int64)
+	if !ok {
+		return time.Time{}, false
+	}
+	ns := start.Load()
+	if ns == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
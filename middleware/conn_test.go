@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sdk_metric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestConnTrackerSlowHeaders(t *testing.T) {
+	reader := sdk_metric.NewManualReader()
+	mp := sdk_metric.NewMeterProvider(sdk_metric.WithReader(reader))
+	instr, err := NewMiddleware(mp.Meter("test"))
+	if err != nil {
+		t.Fatalf("Error creating middleware: %v", err)
+	}
+
+	var tracker ConnTracker
+	srv := httptest.NewUnstartedServer(instr(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})))
+	srv.Listener = tracker.Listener(srv.Listener)
+	srv.Config.ConnContext = tracker.ConnContext
+	srv.Config.ConnState = tracker.ConnState
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	const delay = 200 * time.Millisecond
+	// Both on a new and on a kept-alive connection, the client idles before
+	// sending a request, and then sends its headers slowly. Only the latter
+	// should count.
+	for range 2 {
+		time.Sleep(delay)
+		if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n"); err != nil {
+			t.Fatalf("Error writing request: %v", err)
+		}
+		time.Sleep(delay)
+		if _, err := io.WriteString(conn, "\r\n"); err != nil {
+			t.Fatalf("Error writing request: %v", err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Error reading response: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("Error collecting metrics: %v", err)
+	}
+	var dp metricdata.HistogramDataPoint[float64]
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if h, ok := m.Data.(metricdata.Histogram[float64]); ok && m.Name == "http.server.request.queue.duration" && len(h.DataPoints) == 1 {
+				dp = h.DataPoints[0]
+			}
+		}
+	}
+	if dp.Count != 2 {
+		t.Fatalf("Expected 2 queue duration observations, got %d.", dp.Count)
+	}
+	lowest, _ := dp.Min.Value()
+	highest, _ := dp.Max.Value()
+	if lowest < delay.Seconds() || highest >= 2*delay.Seconds() {
+		t.Errorf("Expected queue durations of about %v, got between %vs and %vs.", delay, lowest, highest)
+	}
+}
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipWriter gzip-compresses the response body that a handler writes and
+// counts the uncompressed bytes. Responses without a body (204, 304) and
+// responses that the handler already encoded itself are passed through.
+//
+// The header of a compressed response is only sent with the first body write,
+// so that the content type can still be sniffed from the uncompressed body.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	status      int
+	wroteHeader bool
+	sentHeader  bool
+	compress    bool
+	written     int64
+}
+
+func newGzipWriter(w http.ResponseWriter) *gzipWriter {
+	return &gzipWriter{ResponseWriter: w}
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+	h := w.Header()
+	if code == http.StatusNoContent || code == http.StatusNotModified || h.Get("Content-Encoding") != "" {
+		w.sendHeader(nil)
+		return
+	}
+	w.compress = true
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+	// The handler's length refers to the uncompressed body.
+	h.Del("Content-Length")
+}
+
+// sendHeader passes the response header on to the underlying writer, after
+// sniffing the content type from the uncompressed body b if necessary. net/http
+// doesn't sniff it from encoded bodies.
+func (w *gzipWriter) sendHeader(b []byte) {
+	if w.sentHeader {
+		return
+	}
+	w.sentHeader = true
+	if _, ok := w.Header()["Content-Type"]; !ok && len(b) > 0 {
+		w.Header().Set("Content-Type", http.DetectContentType(b))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.sendHeader(b)
+	if !w.compress {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.gz == nil {
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	n, err := w.gz.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// replaceStatus replaces the status that the handler wrote but that hasn't
+// been sent yet, so that an error status can still be sent instead.
+func (w *gzipWriter) replaceStatus(code int) {
+	if w.wroteHeader && !w.sentHeader {
+		w.status = code
+	}
+}
+
+// Flush implements http.Flusher, flushing the compressed data written so far.
+func (w *gzipWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.sendHeader(nil)
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close sends the header if the handler hasn't written a body and writes the
+// end of the gzip stream. It must be called once the handler has returned.
+func (w *gzipWriter) Close() error {
+	if !w.wroteHeader {
+		// The handler wrote nothing at all, so leave the response to net/http.
+		return nil
+	}
+	w.sendHeader(nil)
+	if !w.compress {
+		return nil
+	}
+	if w.gz == nil {
+		// Even an empty body needs to be a valid gzip stream.
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	return w.gz.Close()
+}
+
+// Unwrap allows http.ResponseController to access the underlying writer.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// acceptsGzip reports whether an Accept-Encoding header value allows a gzip
+// encoded response.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.TrimSpace(coding)
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		// A quality value of 0 explicitly rules out the encoding.
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && q == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,711 @@
+// Package middleware provides HTTP server middleware that instruments requests
+// with OpenTelemetry metrics and traces.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// scopeName is the instrumentation scope name of the middleware's tracer.
+const scopeName = "github.com/promlabs/go-instrumentation-exercise/middleware"
+
+// DefaultDurationBuckets are the request duration histogram's bucket
+// boundaries (in seconds) if none are configured.
+var DefaultDurationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type config struct {
+	durationBuckets []float64
+	sloThreshold    time.Duration
+	clientSubnet    bool
+	trustForwarded  bool
+	gzip            bool
+	maxBodyBytes    int64
+	headerAttrs     []headerAttribute
+	accessLog       bool
+	rateLimit       float64
+	perRouteLimit   bool
+	maxConcurrent   int
+	concurrencyWait time.Duration
+}
+
+// maxHeaderAttributeLength is the length that header attribute values are
+// truncated to.
+const maxHeaderAttributeLength = 64
+
+// headerAttribute is a request metrics attribute whose value is taken from a
+// request header.
+type headerAttribute struct {
+	name    string
+	header  string
+	pattern *regexp.Regexp
+}
+
+// value returns the attribute's value for r: "unknown" if the header is
+// missing or empty, "invalid" if it doesn't match the pattern, and otherwise
+// the header value truncated to at most maxHeaderAttributeLength bytes without
+// splitting a UTF-8 character.
+func (a headerAttribute) value(r *http.Request) attribute.KeyValue {
+	v := r.Header.Get(a.header)
+	switch {
+	case v == "":
+		v = "unknown"
+	case a.pattern != nil && !a.pattern.MatchString(v):
+		v = "invalid"
+	case len(v) > maxHeaderAttributeLength:
+		n := maxHeaderAttributeLength
+		for n > 0 && !utf8.RuneStart(v[n]) {
+			n--
+		}
+		v = v[:n]
+	}
+	return attribute.String(a.name, v)
+}
+
+// Option configures the middleware returned by NewMiddleware.
+type Option func(*config)
+
+// WithDurationBuckets sets the bucket boundaries (in seconds) of the request
+// duration histogram. If buckets is empty, DefaultDurationBuckets is used.
+func WithDurationBuckets(buckets []float64) Option {
+	return func(c *config) {
+		if len(buckets) > 0 {
+			c.durationBuckets = buckets
+		}
+	}
+}
+
+// WithSLOThreshold enables counting the requests that took less than the given
+// duration, which together with the total request count gives the fraction of
+// requests that met a latency SLO.
+func WithSLOThreshold(threshold time.Duration) Option {
+	return func(c *config) {
+		c.sloThreshold = threshold
+	}
+}
+
+// WithClientSubnet adds a client.subnet attribute to the request duration and
+// request count metrics, which holds the /24 (IPv4) or /48 (IPv6) prefix of the
+// client's address. If trustForwarded is set, the client's address is taken
+// from the last X-Forwarded-For entry, which must then be appended by a trusted
+// proxy in front of the server.
+func WithClientSubnet(trustForwarded bool) Option {
+	return func(c *config) {
+		c.clientSubnet = true
+		c.trustForwarded = trustForwarded
+	}
+}
+
+// WithGzip gzip-compresses responses for clients that accept it, and records
+// the compressed and uncompressed sizes of those responses in two additional
+// histograms.
+func WithGzip() Option {
+	return func(c *config) {
+		c.gzip = true
+	}
+}
+
+// WithMaxBodyBytes limits request bodies to n bytes. Requests with larger
+// bodies are rejected with a 413 and counted in an additional counter.
+func WithMaxBodyBytes(n int64) Option {
+	return func(c *config) {
+		c.maxBodyBytes = n
+	}
+}
+
+// WithHeaderAttribute adds an attribute with the given name to the request
+// duration and request count metrics, whose value is taken from the given
+// request header. Since clients choose the value, it should be bounded: if
+// pattern is not nil, values that don't match it are recorded as "invalid".
+// Missing values are recorded as "unknown". The option can be given multiple
+// times.
+func WithHeaderAttribute(name, header string, pattern *regexp.Regexp) Option {
+	return func(c *config) {
+		c.headerAttrs = append(c.headerAttrs, headerAttribute{name: name, header: header, pattern: pattern})
+	}
+}
+
+// WithAccessLog logs every request's method, route, status code, and duration
+// at info level once it has been handled.
+func WithAccessLog() Option {
+	return func(c *config) {
+		c.accessLog = true
+	}
+}
+
+// WithRateLimit limits requests to rate per second, either in total or, if
+// perRoute is set, for each route separately. Requests beyond the limit are
+// rejected with a 429 and counted in an additional counter.
+func WithRateLimit(rate float64, perRoute bool) Option {
+	return func(c *config) {
+		c.rateLimit = rate
+		c.perRouteLimit = perRoute
+	}
+}
+
+// WithMaxConcurrent limits the number of requests that are handled at once to
+// n. Requests beyond the limit wait up to maxWait for another request to
+// finish, and are then rejected with a 503. The rejected requests and the time
+// that requests waited are recorded in two additional instruments.
+func WithMaxConcurrent(n int, maxWait time.Duration) Option {
+	return func(c *config) {
+		c.maxConcurrent = n
+		c.concurrencyWait = maxWait
+	}
+}
+
+type instruments struct {
+	requestDurations metric.Float64Histogram
+	activeRequests   metric.Int64UpDownCounter
+	requestsTotal    metric.Int64Counter
+	requestSizes     metric.Int64Histogram
+	responseSizes    metric.Int64Histogram
+	panicsTotal      metric.Int64Counter
+	responseBytes    metric.Int64Counter
+	workSeconds      metric.Float64Counter
+	// requestsWithinSLO is nil if no SLO threshold is configured.
+	requestsWithinSLO metric.Int64Counter
+	sloThreshold      time.Duration
+
+	clientSubnet   bool
+	trustForwarded bool
+	headerAttrs    []headerAttribute
+	accessLog      bool
+
+	// compressedSizes and uncompressedSizes are nil unless gzip is enabled.
+	gzip              bool
+	compressedSizes   metric.Int64Histogram
+	uncompressedSizes metric.Int64Histogram
+
+	// bodiesRejected is nil unless request bodies are limited.
+	maxBodyBytes   int64
+	bodiesRejected metric.Int64Counter
+
+	// requestsRejected is nil unless requests are rate limited.
+	limiter          *rateLimiter
+	requestsRejected metric.Int64Counter
+
+	// concurrencyLimited and concurrencyWaits are nil unless the number of
+	// concurrent requests is limited.
+	concurrency        *concurrencyLimiter
+	concurrencyLimited metric.Int64Counter
+	concurrencyWaits   metric.Float64Histogram
+
+	// queueDurations is only recorded for servers that use a ConnTracker.
+	queueDurations metric.Float64Histogram
+
+	attrs *attributeCaches
+}
+
+// NewMiddleware creates the middleware's instruments using the given meter and
+// returns a function that wraps an http.Handler with request instrumentation.
+//
+// The http.route attribute is taken from the pattern of the http.ServeMux
+// route that matched the request rather than from the request path, so that
+// the number of distinct series stays bounded.
+func NewMiddleware(meter metric.Meter, opts ...Option) (func(http.Handler) http.Handler, error) {
+	cfg := config{durationBuckets: DefaultDurationBuckets}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	var (
+		ins instruments
+		err error
+	)
+	ins.requestDurations, err = meter.Float64Histogram(
+		"http.server.request.duration",
+		metric.WithDescription("Duration of HTTP requests."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(cfg.durationBuckets...),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating request duration histogram: %w", err)
+	}
+
+	ins.activeRequests, err = meter.Int64UpDownCounter(
+		"http.server.active_requests",
+		metric.WithDescription("Number of HTTP requests currently being handled."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating active requests counter: %w", err)
+	}
+
+	ins.requestsTotal, err = meter.Int64Counter(
+		"http.server.requests.total",
+		metric.WithDescription("Total number of HTTP requests handled."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating requests counter: %w", err)
+	}
+
+	ins.requestSizes, err = meter.Int64Histogram(
+		"http.server.request.body.size",
+		metric.WithDescription("Size of HTTP request bodies."),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating request body size histogram: %w", err)
+	}
+
+	ins.responseSizes, err = meter.Int64Histogram(
+		"http.server.response.body.size",
+		metric.WithDescription("Size of HTTP response bodies."),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating response body size histogram: %w", err)
+	}
+
+	ins.panicsTotal, err = meter.Int64Counter(
+		"http.server.panics.total",
+		metric.WithDescription("Total number of panics recovered from in HTTP handlers."),
+		metric.WithUnit("{panic}"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating panics counter: %w", err)
+	}
+
+	ins.responseBytes, err = meter.Int64Counter(
+		"http.server.response.bytes.total",
+		metric.WithDescription("Total number of HTTP response body bytes written."),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating response bytes counter: %w", err)
+	}
+
+	// Unlike the duration histogram, this is a plain sum, whose rate is the
+	// average number of requests being handled at once, e.g. for utilization.
+	ins.workSeconds, err = meter.Float64Counter(
+		"http.server.work.seconds.total",
+		metric.WithDescription("Total time spent handling HTTP requests."),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating work seconds counter: %w", err)
+	}
+
+	ins.queueDurations, err = meter.Float64Histogram(
+		"http.server.request.queue.duration",
+		metric.WithDescription("Time between the first byte of an HTTP request arriving and the request's handler running."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating request queue duration histogram: %w", err)
+	}
+
+	ins.attrs = &attributeCaches{}
+	ins.clientSubnet = cfg.clientSubnet
+	ins.trustForwarded = cfg.trustForwarded
+	ins.headerAttrs = cfg.headerAttrs
+	ins.accessLog = cfg.accessLog
+
+	if cfg.gzip {
+		ins.gzip = true
+		ins.compressedSizes, err = meter.Int64Histogram(
+			"http.server.response.body.compressed_size",
+			metric.WithDescription("Size of gzip-compressed HTTP response bodies after compression."),
+			metric.WithUnit("By"),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("creating compressed response body size histogram: %w", err)
+		}
+		ins.uncompressedSizes, err = meter.Int64Histogram(
+			"http.server.response.body.uncompressed_size",
+			metric.WithDescription("Size of gzip-compressed HTTP response bodies before compression."),
+			metric.WithUnit("By"),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("creating uncompressed response body size histogram: %w", err)
+		}
+	}
+
+	if cfg.maxBodyBytes > 0 {
+		ins.maxBodyBytes = cfg.maxBodyBytes
+		ins.bodiesRejected, err = meter.Int64Counter(
+			"http.server.body.rejected.total",
+			metric.WithDescription(fmt.Sprintf("Total number of HTTP requests rejected for a body larger than %d bytes.", cfg.maxBodyBytes)),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("creating rejected bodies counter: %w", err)
+		}
+	}
+
+	if cfg.rateLimit > 0 {
+		ins.limiter = newRateLimiter(cfg.rateLimit, cfg.perRouteLimit)
+		ins.requestsRejected, err = meter.Int64Counter(
+			"http.server.requests.rejected.total",
+			metric.WithDescription("Total number of HTTP requests rejected before reaching their handler."),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("creating rejected requests counter: %w", err)
+		}
+	}
+
+	if cfg.maxConcurrent > 0 {
+		ins.concurrency = newConcurrencyLimiter(cfg.maxConcurrent, cfg.concurrencyWait)
+		ins.concurrencyLimited, err = meter.Int64Counter(
+			"http.server.concurrency.limited.total",
+			metric.WithDescription(fmt.Sprintf("Total number of HTTP requests rejected because %d requests were already being handled.", cfg.maxConcurrent)),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("creating concurrency limited counter: %w", err)
+		}
+		ins.concurrencyWaits, err = meter.Float64Histogram(
+			"http.server.concurrency.wait.duration",
+			metric.WithDescription("Time that HTTP requests waited for fewer requests to be handled concurrently."),
+			metric.WithUnit("s"),
+			metric.WithExplicitBucketBoundaries(0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("creating concurrency wait duration histogram: %w", err)
+		}
+	}
+
+	if cfg.sloThreshold > 0 {
+		ins.sloThreshold = cfg.sloThreshold
+		ins.requestsWithinSLO, err = meter.Int64Counter(
+			"http.server.requests.within_slo",
+			metric.WithDescription(fmt.Sprintf("Total number of HTTP requests handled in less than the latency SLO threshold of %v.", cfg.sloThreshold)),
+			metric.WithUnit("{request}"),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("creating requests within SLO counter: %w", err)
+		}
+	}
+
+	// The tracer is a no-op unless a global TracerProvider has been set up.
+	tracer := otel.Tracer(scopeName)
+
+	return func(next http.Handler) http.Handler {
+		return instrument(ins, tracer, next)
+	}, nil
+}
+
+func instrument(ins instruments, tracer trace.Tracer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := newStatusWriter(w)
+		route := routeFromPattern(r.Pattern)
+		routeOnlyAttrs := ins.attrs.routeOnly.get(route, func() []attribute.KeyValue {
+			return []attribute.KeyValue{attribute.String("http.route", route)}
+		})
+
+		// Continue the caller's trace if the request carries a trace context,
+		// e.g. a W3C traceparent header set by a tracing proxy.
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, route, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		sw.onWrite = func(n int64) {
+			ins.responseBytes.Add(ctx, n, routeOnlyAttrs)
+		}
+
+		method := r.Method
+		routeAttrs := ins.attrs.route.get(routeKey{route: route, method: method}, func() []attribute.KeyValue {
+			return []attribute.KeyValue{
+				attribute.String("http.route", route),
+				attribute.String("http.request.method", method),
+			}
+		})
+		// The client subnet and header attributes have too many values to cache,
+		// so they are passed as a separate option when enabled.
+		var extraAttrs metric.MeasurementOption
+		if ins.clientSubnet || len(ins.headerAttrs) > 0 {
+			attrs := make([]attribute.KeyValue, 0, len(ins.headerAttrs)+1)
+			if ins.clientSubnet {
+				attrs = append(attrs, attribute.String("client.subnet", clientSubnet(r, ins.trustForwarded)))
+			}
+			for _, a := range ins.headerAttrs {
+				attrs = append(attrs, a.value(r))
+			}
+			extraAttrs = metric.WithAttributes(attrs...)
+		}
+		ins.activeRequests.Add(r.Context(), 1, routeAttrs)
+		defer ins.activeRequests.Add(r.Context(), -1, routeAttrs)
+		if reqStart, ok := requestStart(r.Context()); ok {
+			ins.queueDurations.Record(r.Context(), start.Sub(reqStart).Seconds(), routeAttrs)
+		}
+
+		// The handler writes to the gzip writer, which writes the compressed body
+		// to sw, so that sw still sees what is actually sent.
+		var (
+			gw   *gzipWriter
+			body http.ResponseWriter = sw
+		)
+		if ins.gzip && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			gw = newGzipWriter(sw)
+			body = gw
+		}
+
+		defer func() {
+			// Keep a panicking handler from taking down the whole server, but let
+			// http.ErrAbortHandler through, since it is used to deliberately abort
+			// a response.
+			rec := recover()
+			if rec != nil && rec != http.ErrAbortHandler {
+				slog.ErrorContext(r.Context(), "Recovered from panic in HTTP handler.", "route", route, "path", r.URL.Path, "panic", rec)
+				ins.panicsTotal.Add(r.Context(), 1, routeOnlyAttrs)
+				if !sw.wroteHeader {
+					if gw != nil {
+						gw.replaceStatus(http.StatusInternalServerError)
+					}
+					http.Error(body, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+			}
+			if gw != nil {
+				gw.Close()
+			}
+
+			span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+			if sw.status >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(sw.status))
+			}
+
+			// Recording with the request's context attaches the current span as an
+			// exemplar to the bucket that the observed duration falls into, e.g. a
+			// 70ms request's exemplar shows up on the le="0.1" bucket. Prometheus
+			// needs to run with --enable-feature=exemplar-storage to keep them.
+			duration := time.Since(start)
+			dk := durationKey{
+				routeKey:    routeKey{route: route, method: method},
+				status:      sw.status,
+				cancelled:   errors.Is(r.Context().Err(), context.Canceled),
+				outcome:     outcome(r.Context(), sw.status),
+				contentType: contentTypeClass(sw.contentType),
+			}
+			durationAttrs := ins.attrs.duration.get(dk, func() []attribute.KeyValue {
+				return []attribute.KeyValue{
+					attribute.String("http.route", dk.route),
+					attribute.String("http.request.method", dk.method),
+					attribute.Int("http.response.status_code", dk.status),
+					attribute.Bool("http.request.cancelled", dk.cancelled),
+					attribute.String("outcome", dk.outcome),
+					attribute.String("http.response.content_type", dk.contentType),
+				}
+			})
+			if extraAttrs != nil {
+				ins.requestDurations.Record(r.Context(), duration.Seconds(), durationAttrs, extraAttrs)
+			} else {
+				ins.requestDurations.Record(r.Context(), duration.Seconds(), durationAttrs)
+			}
+
+			ck := countKey{routeKey: dk.routeKey, statusClass: sw.status / 100}
+			countAttrs := ins.attrs.count.get(ck, func() []attribute.KeyValue {
+				return []attribute.KeyValue{
+					attribute.String("http.route", ck.route),
+					attribute.String("http.request.method", ck.method),
+					attribute.String("http.response.status_class", statusClass(sw.status)),
+				}
+			})
+			if extraAttrs != nil {
+				ins.requestsTotal.Add(r.Context(), 1, countAttrs, extraAttrs)
+			} else {
+				ins.requestsTotal.Add(r.Context(), 1, countAttrs)
+			}
+			ins.workSeconds.Add(r.Context(), duration.Seconds(), routeOnlyAttrs)
+			if ins.requestsWithinSLO != nil && duration < ins.sloThreshold {
+				ins.requestsWithinSLO.Add(r.Context(), 1, routeAttrs)
+			}
+
+			// A ContentLength of -1 means that the request size is unknown.
+			if r.ContentLength >= 0 {
+				ins.requestSizes.Record(r.Context(), r.ContentLength, routeAttrs)
+			}
+			ins.responseSizes.Record(r.Context(), sw.written, routeAttrs)
+			if gw != nil && gw.compress {
+				ins.compressedSizes.Record(r.Context(), sw.written, routeAttrs)
+				ins.uncompressedSizes.Record(r.Context(), gw.written, routeAttrs)
+			}
+
+			if ins.accessLog {
+				slog.InfoContext(r.Context(), "Handled request.", "method", method, "route", route, "path", r.URL.Path, "status", sw.status, "duration", duration)
+			}
+
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+		}()
+
+		if ins.limiter != nil && !ins.limiter.allow(route) {
+			ins.requestsRejected.Add(r.Context(), 1, metric.WithAttributes(
+				attribute.String("http.route", route),
+				attribute.String("reason", "rate_limited"),
+			))
+			body.Header().Set("Retry-After", "1")
+			http.Error(body, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		if ins.concurrency != nil {
+			waitStart := time.Now()
+			acquired := ins.concurrency.acquire(r.Context())
+			ins.concurrencyWaits.Record(r.Context(), time.Since(waitStart).Seconds(), routeOnlyAttrs)
+			if !acquired {
+				ins.concurrencyLimited.Add(r.Context(), 1, routeOnlyAttrs)
+				http.Error(body, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			defer ins.concurrency.release()
+		}
+
+		if ins.maxBodyBytes <= 0 {
+			next.ServeHTTP(body, r)
+			return
+		}
+
+		// Reject bodies that are known to be too large up front. Otherwise, the
+		// handler sees an error once it has read past the limit.
+		if r.ContentLength > ins.maxBodyBytes {
+			ins.bodiesRejected.Add(r.Context(), 1, routeOnlyAttrs)
+			http.Error(body, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		lb := &limitedBody{ReadCloser: http.MaxBytesReader(body, r.Body, ins.maxBodyBytes)}
+		r.Body = lb
+		next.ServeHTTP(body, r)
+		if lb.exceeded {
+			ins.bodiesRejected.Add(r.Context(), 1, routeOnlyAttrs)
+			if !sw.wroteHeader {
+				if gw != nil {
+					gw.replaceStatus(http.StatusRequestEntityTooLarge)
+				}
+				http.Error(body, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			}
+		}
+	})
+}
+
+// limitedBody wraps a request body returned by http.MaxBytesReader and
+// remembers whether the handler tried to read past the limit.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// routeFromPattern returns the path part of an http.ServeMux pattern such as
+// "GET example.com/api/users/{id}". Requests that were not routed through a
+// ServeMux have no pattern and are reported as "<unknown>".
+func routeFromPattern(pattern string) string {
+	if pattern == "" {
+		return "<unknown>"
+	}
+	if i := strings.IndexByte(pattern, '/'); i >= 0 {
+		return pattern[i:]
+	}
+	return pattern
+}
+
+// clientSubnet returns the /24 (IPv4) or /48 (IPv6) prefix of the client's
+// address, or "<unknown>" if the address can't be parsed. If trustForwarded is
+// set, the rightmost X-Forwarded-For address is used when present, since that's
+// the one appended by the trusted proxy. The entries before it are set by the
+// client, which could forge them.
+func clientSubnet(r *http.Request, trustForwarded bool) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if trustForwarded {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			xff := values[len(values)-1]
+			if i := strings.LastIndexByte(xff, ','); i >= 0 {
+				xff = xff[i+1:]
+			}
+			addr = strings.TrimSpace(xff)
+		}
+	}
+
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return "<unknown>"
+	}
+	ip = ip.Unmap()
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return "<unknown>"
+	}
+	return prefix.String()
+}
+
+// contentTypeClass maps a Content-Type header value to one of a few classes
+// ("json", "text", "html", or "other") to keep the attribute's cardinality low.
+func contentTypeClass(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "other"
+	}
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return "json"
+	case mediaType == "text/plain":
+		return "text"
+	case mediaType == "text/html":
+		return "html"
+	default:
+		return "other"
+	}
+}
+
+// outcome classifies a request as "ok", "client_error", "server_error",
+// "timeout" (the request context's deadline passed), or "cancelled" (the
+// request context was cancelled, e.g. because the client went away).
+func outcome(ctx context.Context, status int) string {
+	switch err := ctx.Err(); {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case status >= 500:
+		return "server_error"
+	case status >= 400:
+		return "client_error"
+	default:
+		return "ok"
+	}
+}
+
+// statusClass returns the class of an HTTP status code, e.g. "2xx" for 200.
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
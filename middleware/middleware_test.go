@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sdk_metric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+func BenchmarkMiddleware(b *testing.B) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+
+	mp := sdk_metric.NewMeterProvider(sdk_metric.WithReader(sdk_metric.NewManualReader()))
+	instr, err := NewMiddleware(mp.Meter("benchmark"))
+	if err != nil {
+		b.Fatalf("Error creating middleware: %v", err)
+	}
+
+	for _, bc := range []struct {
+		name    string
+		handler http.Handler
+	}{
+		{name: "uninstrumented", handler: handler},
+		{name: "instrumented", handler: instr(handler)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			mux := http.NewServeMux()
+			mux.Handle("/api/foo", bc.handler)
+
+			b.ReportAllocs()
+			for b.Loop() {
+				mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/foo", nil))
+			}
+		})
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		remoteAddr     string
+		forwardedFor   []string
+		trustForwarded bool
+		want           string
+	}{
+		{
+			name:       "IPv4 remote address",
+			remoteAddr: "192.0.2.17:51234",
+			want:       "192.0.2.0/24",
+		},
+		{
+			name:       "IPv6 remote address",
+			remoteAddr: "[2001:db8:1234:5678::1]:51234",
+			want:       "2001:db8:1234::/48",
+		},
+		{
+			name:       "IPv4-mapped IPv6 remote address",
+			remoteAddr: "[::ffff:192.0.2.17]:51234",
+			want:       "192.0.2.0/24",
+		},
+		{
+			name:         "untrusted X-Forwarded-For",
+			remoteAddr:   "192.0.2.17:51234",
+			forwardedFor: []string{"198.51.100.7"},
+			want:         "192.0.2.0/24",
+		},
+		{
+			name:           "trusted IPv4 X-Forwarded-For",
+			remoteAddr:     "192.0.2.17:51234",
+			forwardedFor:   []string{"198.51.100.7"},
+			trustForwarded: true,
+			want:           "198.51.100.0/24",
+		},
+		{
+			name:           "trusted IPv6 X-Forwarded-For",
+			remoteAddr:     "192.0.2.17:51234",
+			forwardedFor:   []string{"2001:db8:abcd:1::7"},
+			trustForwarded: true,
+			want:           "2001:db8:abcd::/48",
+		},
+		{
+			name:           "multi-hop X-Forwarded-For uses the proxy's entry",
+			remoteAddr:     "192.0.2.17:51234",
+			forwardedFor:   []string{"203.0.113.1, 198.51.100.7"},
+			trustForwarded: true,
+			want:           "198.51.100.0/24",
+		},
+		{
+			name:           "multiple X-Forwarded-For headers use the last one",
+			remoteAddr:     "192.0.2.17:51234",
+			forwardedFor:   []string{"203.0.113.1", "198.51.100.7"},
+			trustForwarded: true,
+			want:           "198.51.100.0/24",
+		},
+		{
+			name:           "malformed X-Forwarded-For",
+			remoteAddr:     "192.0.2.17:51234",
+			forwardedFor:   []string{"203.0.113.1, not-an-ip"},
+			trustForwarded: true,
+			want:           "<unknown>",
+		},
+		{
+			name:           "empty last X-Forwarded-For entry",
+			remoteAddr:     "192.0.2.17:51234",
+			forwardedFor:   []string{"203.0.113.1,"},
+			trustForwarded: true,
+			want:           "<unknown>",
+		},
+		{
+			name:       "malformed remote address",
+			remoteAddr: "not-an-ip",
+			want:       "<unknown>",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, v := range tc.forwardedFor {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientSubnet(r, tc.trustForwarded); got != tc.want {
+				t.Errorf("Expected client subnet %q, got %q.", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket rate limiter, with either a single bucket for
+// all requests or one bucket per route.
+type rateLimiter struct {
+	// rate is the number of tokens added per second, and burst the maximum
+	// number of tokens in a bucket.
+	rate     float64
+	burst    float64
+	perRoute bool
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, perRoute bool) *rateLimiter {
+	return &rateLimiter{
+		rate: rate,
+		// Allow bursts of up to a second's worth of requests.
+		burst:    math.Max(1, rate),
+		perRoute: perRoute,
+		buckets:  map[string]*tokenBucket{},
+	}
+}
+
+// allow reports whether a request for route may be handled now, and takes a
+// token from its bucket if so.
+func (l *rateLimiter) allow(route string) bool {
+	if !l.perRoute {
+		route = ""
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[route]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[route] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+)
+
+// statusWriter wraps an http.ResponseWriter and remembers the status code and
+// content type that the wrapped handler sent, as well as the number of body
+// bytes written. If the handler never calls WriteHeader explicitly, the status
+// defaults to 200, just like in net/http.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	contentType string
+	wroteHeader bool
+	written     int64
+
+	// onWrite, if set, is called with the number of bytes of every body write.
+	onWrite func(n int64)
+}
+
+func (w *statusWriter) countWritten(n int64) {
+	w.written += n
+	if w.onWrite != nil && n > 0 {
+		w.onWrite(n)
+	}
+}
+
+func newStatusWriter(w http.ResponseWriter) *statusWriter {
+	return &statusWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+// markHeaderWritten records that the response header has been sent, along
+// with the content type it contained.
+func (w *statusWriter) markHeaderWritten() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.contentType = w.Header().Get("Content-Type")
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	// Informational (1xx) responses may be followed by the real response header.
+	if !w.wroteHeader && code >= 200 {
+		w.status = code
+		w.markHeaderWritten()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		// Sniff the content type like net/http would, so that we know it too.
+		if _, ok := w.Header()["Content-Type"]; !ok && len(b) > 0 {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.markHeaderWritten()
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.countWritten(int64(n))
+	return n, err
+}
+
+// Flush implements http.Flusher so that streaming handlers keep working
+// when the underlying writer supports flushing.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.markHeaderWritten()
+		f.Flush()
+	}
+}
+
+// ReadFrom implements io.ReaderFrom so that the underlying writer's
+// optimized copy path (e.g. sendfile) is still used where available.
+func (w *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.markHeaderWritten()
+	var (
+		n   int64
+		err error
+	)
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		// Hide our own ReadFrom method from io.Copy to avoid infinite recursion.
+		n, err = io.Copy(struct{ io.Writer }{w.ResponseWriter}, src)
+	}
+	w.countWritten(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to access the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}